@@ -0,0 +1,77 @@
+package openkey
+
+import "github.com/clausecker/freefare"
+
+// The configuration of an openkey application as reported by AccessRights().
+// Key numbers refer to the keys of the application: key 0 is the application
+// master key, key 1 the read key, key 2 the authentication key, and key 3 the
+// update key.
+type AppAccessRights struct {
+	KeySettings byte // application key settings
+	MaxKeys     int  // number of keys of the application
+
+	Files []FileAccessRights // the files of the application
+}
+
+// The configuration of a file in an openkey application. Use
+// freefare.SplitDESFireAccessRights() to split AccessRights.
+type FileAccessRights struct {
+	FileNo                byte
+	Size                  uint32 // size of the standard data file in bytes
+	CommunicationSettings byte   // freefare.Plain or freefare.Enciphered
+	AccessRights          uint16
+}
+
+// Report the configuration of the applications the libopenkey writes. These
+// settings are fixed: the producer creates the applications with them and
+// owning a card only changes the keys, not the access rights, so there is no
+// way to customize them. The settings are
+//
+//   - application key settings 0xE0: keys 1 to 3 can each be changed after
+//     authenticating with them, the application master key and the key
+//     settings are frozen, and listing files requires the application master
+//     key
+//   - file 1 holds the card ID without dashes (32 bytes), read with key 1,
+//     never written after production, enciphered communication
+//   - file 2 holds authenticity data (64 bytes), read with key 2, read and
+//     written with key 3, access rights changed with key 3, enciphered
+//     communication
+//
+// The settings are the same for all slots.
+func AccessRights() AppAccessRights {
+	return AppAccessRights{
+		KeySettings: 0xe0, // OPENKEY_FINAL_APPLICATION_SETTINGS
+		MaxKeys:     4,
+		Files: []FileAccessRights{{
+			FileNo:                1,
+			Size:                  mangledCardIDLength,
+			CommunicationSettings: freefare.Enciphered,
+			AccessRights:          freefare.MakeDESFireAccessRights(1, 0xf, 0xf, 0xf),
+		}, {
+			FileNo:                2,
+			Size:                  64,
+			CommunicationSettings: freefare.Enciphered,
+			AccessRights:          freefare.MakeDESFireAccessRights(2, 0xf, 3, 3),
+		}},
+	}
+}
+
+// Returned by CardAuthTriesRemaining() for keys that never lock.
+const AuthTriesUnlimited = -1
+
+// Report how many failed authentications key number keyNo of an openkey
+// application tolerates before it locks. The libopenkey does not configure
+// keys with a limited number of tries: DESFire EV1 cards have no such limit
+// and the failed authentication counter of later DESFire generations is left
+// disabled, so no wrong password can lock a card and this function always
+// returns AuthTriesUnlimited. The card is not accessed; tag is taken so
+// callers need not change should this ever differ between cards. Use
+// PreAuthHook to limit password attempts instead. If keyNo is not a key of
+// the application, see AccessRights(), ErrInvalidArgument is returned.
+func CardAuthTriesRemaining(tag freefare.DESFireTag, keyNo byte) (int, error) {
+	if int(keyNo) >= AccessRights().MaxKeys {
+		return 0, ErrInvalidArgument
+	}
+
+	return AuthTriesUnlimited, nil
+}
@@ -0,0 +1,151 @@
+package openkey
+
+// #include <gcrypt.h>
+//
+// // Encrypt buf in place with algo in CBC mode with an all-zero IV as needed
+// // to compute a CMAC. Returns a libgcrypt error code.
+// static gcry_error_t cbc_encrypt(int algo, const void *key, size_t key_length,
+// 		void *buf, size_t length)
+// {
+// 	gcry_cipher_hd_t hd;
+// 	gcry_error_t err = gcry_cipher_open(&hd, algo, GCRY_CIPHER_MODE_CBC, GCRY_CIPHER_SECURE);
+// 	if(err)
+// 		return err;
+//
+// 	err = gcry_cipher_setkey(hd, key, key_length);
+// 	if(!err)
+// 		err = gcry_cipher_encrypt(hd, buf, length, NULL, 0);
+//
+// 	gcry_cipher_close(hd);
+// 	return err;
+// }
+import "C"
+import "unsafe"
+
+// Parameters of the AN10922 diversification for a key type.
+type an10922Params struct {
+	algo      C.int
+	keyLength int    // length of the master key
+	blockSize int    // block size of the cipher
+	rb        byte   // constant for the CMAC subkey generation
+	consts    []byte // diversification constants, one per block of output
+}
+
+// The key types KdfAN10922() supports. AN10922 does not cover single DES.
+var an10922Types = map[KeyType]an10922Params{
+	Key3DES:   {C.GCRY_CIPHER_3DES, 16, 8, 0x1b, []byte{0x21, 0x22}},
+	Key3K3DES: {C.GCRY_CIPHER_3DES, 24, 8, 0x1b, []byte{0x31, 0x32, 0x33}},
+	KeyAES:    {C.GCRY_CIPHER_AES128, 16, 16, 0x87, []byte{0x01}},
+}
+
+// Diversify masterKey with divInput as described in NXP application note
+// AN10922 "Symmetric key diversifications", the scheme implemented by
+// libfreefare's key deriver. This scheme is unrelated to Kdf() and is meant for
+// migrating cards personalized with it. keyType is the type of both masterKey
+// and the derived key: KeyAES for AES-128, Key3DES for two-key triple DES, or
+// Key3K3DES for three-key triple DES; single DES is not covered by AN10922.
+// divInput, e.g. the UID followed by the AID and a system identifier, must be 1
+// to 31 bytes long for AES and 1 to 15 bytes long for triple DES. The derived
+// key is as long as masterKey. AN10922 carries the key version of a triple DES
+// master key over to the derived key; this function returns the bits as
+// derived, so turn the result into a freefare.DESFireKey and set its version
+// with SetVersion(). If keyType is not supported or masterKey or divInput has
+// the wrong length, ErrInvalidArgument is returned. As a side-effect, this
+// function initializes the libgcrypt which is used for the cipher operations;
+// if that fails, ErrGcryptNotInitialized is returned.
+func KdfAN10922(masterKey []byte, divInput []byte, keyType KeyType) ([]byte, error) {
+	p, ok := an10922Types[keyType]
+	if !ok || len(masterKey) != p.keyLength ||
+		len(divInput) == 0 || len(divInput) > 2*p.blockSize-1 {
+		return nil, ErrInvalidArgument
+	}
+
+	err := initGcrypt()
+	if err != nil {
+		return nil, err
+	}
+
+	// the libgcrypt takes two-key triple DES keys as K1 K2 K1
+	key := append([]byte{}, masterKey...)
+	if keyType == Key3DES {
+		key = append(key, masterKey[:8]...)
+	}
+
+	defer zero(key)
+
+	// CMAC subkeys
+	l := make([]byte, p.blockSize)
+	err = cbcEncrypt(p.algo, key, l)
+	if err != nil {
+		return nil, err
+	}
+
+	k1 := cmacSubkey(l, p.rb)
+	zero(l)
+	defer zero(k1)
+	k2 := cmacSubkey(k1, p.rb)
+	defer zero(k2)
+
+	// the message is always padded to two blocks
+	msg := make([]byte, 2*p.blockSize)
+	defer zero(msg)
+
+	derived := make([]byte, 0, len(p.consts)*p.blockSize)
+	for _, c := range p.consts {
+		zero(msg)
+		msg[0] = c
+		n := 1 + copy(msg[1:], divInput)
+
+		subkey := k1
+		if n < len(msg) {
+			msg[n] = 0x80
+			subkey = k2
+		}
+
+		last := msg[p.blockSize:]
+		for i := range last {
+			last[i] ^= subkey[i]
+		}
+
+		err = cbcEncrypt(p.algo, key, msg)
+		if err != nil {
+			zero(derived)
+			return nil, err
+		}
+
+		derived = append(derived, msg[p.blockSize:]...)
+	}
+
+	return derived, nil
+}
+
+// Encrypt buf in place with algo in CBC mode with an all-zero IV. The last
+// block of buf is then the CBC-MAC of its previous contents.
+func cbcEncrypt(algo C.int, key, buf []byte) error {
+	r := C.cbc_encrypt(algo, unsafe.Pointer(&key[0]), C.size_t(len(key)),
+		unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+	if r != 0 {
+		return gcryptError(r)
+	}
+
+	return nil
+}
+
+// Derive a CMAC subkey from the previous subkey or the encrypted zero block
+// k: shift k left by one bit and xor rb into the last byte if the bit shifted
+// out is set.
+func cmacSubkey(k []byte, rb byte) []byte {
+	sub := make([]byte, len(k))
+	for i := range k {
+		sub[i] = k[i] << 1
+		if i+1 < len(k) {
+			sub[i] |= k[i+1] >> 7
+		}
+	}
+
+	if k[0]&0x80 != 0 {
+		sub[len(sub)-1] ^= rb
+	}
+
+	return sub
+}
@@ -0,0 +1,87 @@
+package openkey
+
+import "bytes"
+import "encoding/hex"
+import "testing"
+
+// The examples of NXP application note AN10922 "Symmetric key
+// diversifications". The diversification input is the UID 04782E21801D80, the
+// AID 3042F5, and a prefix of the system identifier "NXP Abu". For triple DES,
+// AN10922 lists the derived key with the key version of the master key (0x55)
+// carried over into the parity bits of its first eight bytes, see
+// setKeyVersion().
+var an10922Tests = []struct {
+	name      string
+	keyType   KeyType
+	masterKey string
+	divInput  string
+	version   byte
+	derived   string
+}{
+	{"AES", KeyAES,
+		"00112233445566778899AABBCCDDEEFF",
+		"04782E21801D803042F54E585020416275", 0,
+		"A8DD63A3B89D54B37CA802473FDA9175"},
+	{"2TDEA", Key3DES,
+		"00112233445566778899AABBCCDDEEFF",
+		"04782E21801D803042F54E58502041", 0x55,
+		"16F9587D9E8910C96B9648D006107DD7"},
+	{"3TDEA", Key3K3DES,
+		"00112233445566778899AABBCCDDEEFF0102030405060708",
+		"04782E21801D803042F54E5850", 0x55,
+		"2E0DD03774D3FA9B5705AB0BDA91CA0B55B8E07FCDBF10EC"},
+}
+
+// Store version in the parity bits of the first eight bytes of key, most
+// significant bit first, as AN10922 does for triple DES keys.
+func setKeyVersion(key []byte, version byte) {
+	for i := 0; i < 8; i++ {
+		key[i] = key[i]&^1 | version>>uint(7-i)&1
+	}
+}
+
+func TestKdfAN10922(t *testing.T) {
+	for _, tt := range an10922Tests {
+		masterKey, _ := hex.DecodeString(tt.masterKey)
+		divInput, _ := hex.DecodeString(tt.divInput)
+		want, _ := hex.DecodeString(tt.derived)
+
+		got, err := KdfAN10922(masterKey, divInput, tt.keyType)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if tt.keyType != KeyAES {
+			setKeyVersion(got, tt.version)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: derived %X, want %X", tt.name, got, want)
+		}
+	}
+}
+
+func TestKdfAN10922InvalidArguments(t *testing.T) {
+	key16 := make([]byte, 16)
+	tests := []struct {
+		name      string
+		masterKey []byte
+		divInput  []byte
+		keyType   KeyType
+	}{
+		{"single DES", make([]byte, 8), []byte{1}, KeyDES},
+		{"short AES key", key16[:15], []byte{1}, KeyAES},
+		{"empty input", key16, nil, KeyAES},
+		{"AES input too long", key16, make([]byte, 32), KeyAES},
+		{"2TDEA input too long", key16, make([]byte, 16), Key3DES},
+		{"3TDEA key too short", key16, []byte{1}, Key3K3DES},
+	}
+
+	for _, tt := range tests {
+		_, err := KdfAN10922(tt.masterKey, tt.divInput, tt.keyType)
+		if err != ErrInvalidArgument {
+			t.Errorf("%s: got error %v, want ErrInvalidArgument", tt.name, err)
+		}
+	}
+}
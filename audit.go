@@ -0,0 +1,80 @@
+package openkey
+
+import "log/syslog"
+import "strconv"
+
+import "github.com/clausecker/freefare"
+
+// Log the outcome of each authentication by AuthenticateCard(),
+// AuthenticateAny(), and the authentication streams to the system log with
+// the given tag, facility LOG_AUTHPRIV. Granted accesses are logged with
+// priority LOG_INFO, denied ones with LOG_WARNING. Each message is a list of
+// key=value pairs, e.g.
+//
+//	decision=deny card_id=0ff2a8c4-... uid=08a1b2c3 reader="pn532_uart:/dev/ttyUSB0" error="openkey: card has been revoked"
+//
+// card_id is present if the card ID is known, i.e. if access was granted or
+// the card was denied because of its ID. uid is the UID the card presented
+// during anti-collision, which is random for cards written by the libopenkey.
+// reader is the connection string of the reader and error is only present
+// for denied accesses. Failures to write to the system log are ignored. If the
+// connection to the system log cannot be established, the error is returned
+// and the previous setting remains in effect. Pass "" to stop logging. The
+// connection is closed once c and the contexts cloned from it for a
+// MultiReader have all been closed.
+//
+// Only authentications by AuthenticateCard() are logged, including those
+// other functions such as AuthenticateAny(), VerifyCards(), and the
+// authentication streams make through it. Other card operations, e.g.
+// producing or owning a card or the key checks of SelfTestCard(), are not.
+func (c Context) SetAuditSyslog(tag string) error {
+	var w *syslog.Writer
+	if tag != "" {
+		var err error
+		w, err = syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.s.mu.Lock()
+	old := c.s.audit
+	c.s.audit = w
+	c.s.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
+
+// Write an audit message for the authentication of tag that yielded cardId
+// and err to the system log if enabled.
+func (c Context) auditAuthentication(tag freefare.DESFireTag, cardId string, err error) {
+	c.s.mu.RLock()
+	w := c.s.audit
+	c.s.mu.RUnlock()
+
+	if w == nil {
+		return
+	}
+
+	decision := "grant"
+	if err != nil {
+		decision = "deny"
+	}
+
+	msg := "decision=" + decision
+	if cardId != "" {
+		msg += " card_id=" + cardId
+	}
+
+	msg += " uid=" + tag.UID() + " reader=" + strconv.Quote(tag.Device().Connection())
+	if err != nil {
+		msg += " error=" + strconv.Quote(err.Error())
+		w.Warning(msg)
+	} else {
+		w.Info(msg)
+	}
+}
@@ -0,0 +1,53 @@
+package openkey
+
+import "sort"
+import "time"
+
+import "github.com/clausecker/freefare"
+
+// Latencies measured by BenchmarkAuth(). P50, P90, and P99 are the 50th,
+// 90th, and 99th percentile of the latencies.
+type BenchResult struct {
+	N              int
+	Min, Max, Mean time.Duration
+	P50, P90, P99  time.Duration
+}
+
+// Authenticate the card on tag n times using AuthenticateCard() and report the
+// latencies observed. Each latency is measured around a call to
+// AuthenticateCard() and thus includes everything the wrapper does. If an
+// authentication fails, its error is returned and the benchmark is aborted.
+// If n is not positive, an empty result is returned.
+func (c Context) BenchmarkAuth(tag freefare.DESFireTag, pw []byte, n int) (BenchResult, error) {
+	if n <= 0 {
+		return BenchResult{}, nil
+	}
+
+	latencies := make([]time.Duration, n)
+	var total time.Duration
+	for i := range latencies {
+		start := time.Now()
+		_, err := c.AuthenticateCard(tag, pw)
+		latencies[i] = time.Since(start)
+		if err != nil {
+			return BenchResult{}, err
+		}
+
+		total += latencies[i]
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) time.Duration {
+		return latencies[(n-1)*p/100]
+	}
+
+	return BenchResult{
+		N:    n,
+		Min:  latencies[0],
+		Max:  latencies[n-1],
+		Mean: total / time.Duration(n),
+		P50:  percentile(50),
+		P90:  percentile(90),
+		P99:  percentile(99),
+	}, nil
+}
@@ -0,0 +1,303 @@
+package openkey
+
+// #include <gcrypt.h>
+//
+// // Encrypt or decrypt buf in place with AES-256-GCM. header is authenticated
+// // but not encrypted. When encrypting, the tag is written to tag, when
+// // decrypting, it is checked against tag. Returns a libgcrypt error code.
+// static gcry_error_t bundle_crypt(int encrypt, const void *key, const void *nonce,
+// 		const void *header, size_t header_length,
+// 		void *buf, size_t length, void *tag)
+// {
+// 	gcry_cipher_hd_t hd;
+// 	gcry_error_t err = gcry_cipher_open(&hd, GCRY_CIPHER_AES256, GCRY_CIPHER_MODE_GCM, GCRY_CIPHER_SECURE);
+// 	if(err)
+// 		return err;
+//
+// 	if((err = gcry_cipher_setkey(hd, key, 32))
+// 			|| (err = gcry_cipher_setiv(hd, nonce, 12))
+// 			|| (err = gcry_cipher_authenticate(hd, header, header_length)))
+// 		goto out;
+//
+// 	if(encrypt) {
+// 		if((err = gcry_cipher_encrypt(hd, buf, length, NULL, 0)))
+// 			goto out;
+// 		err = gcry_cipher_gettag(hd, tag, 16);
+// 	} else {
+// 		if((err = gcry_cipher_decrypt(hd, buf, length, NULL, 0)))
+// 			goto out;
+// 		err = gcry_cipher_checktag(hd, tag, 16);
+// 	}
+//
+// out:
+// 	gcry_cipher_close(hd);
+// 	return err;
+// }
+import "C"
+import "archive/tar"
+import "bytes"
+import "crypto/rand"
+import "errors"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "unsafe"
+
+// Layout of a role bundle: magic, role, salt, and nonce form the header which
+// is followed by the encrypted tar archive and the authentication tag.
+const (
+	bundleMagic      = "OKBUNDL1"
+	bundleSaltSize   = 16
+	bundleNonceSize  = 12
+	bundleTagSize    = 16
+	bundleKeySize    = 32
+	bundleHeaderSize = len(bundleMagic) + 1 + bundleSaltSize + bundleNonceSize
+
+	// PBKDF2 iterations to derive the bundle key from the passphrase
+	bundleIterations = 100000
+)
+
+// Export the key material of role as an encrypted bundle. All files below the
+// base path of role are packed into a tar archive which is encrypted with
+// AES-256-GCM under a key derived from passphrase with PBKDF2. Use
+// ImportRole() to unpack the bundle on another machine. If role has not been
+// added to c, ErrRoleNotAdded is returned.
+func (c Context) ExportRole(role Role, passphrase []byte) ([]byte, error) {
+	base, err := c.basePath(role)
+	if err != nil {
+		return nil, err
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	err = filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == base {
+			return err
+		}
+
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		name, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(name)
+		err = tw.WriteHeader(hdr)
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = tw.Write(data)
+		zero(data)
+		return err
+	})
+
+	if err == nil {
+		err = tw.Close()
+	}
+
+	plain := archive.Bytes()
+	defer zero(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := make([]byte, bundleHeaderSize, bundleHeaderSize+len(plain)+bundleTagSize)
+	copy(bundle, bundleMagic)
+	bundle[len(bundleMagic)] = byte(role)
+	_, err = io.ReadFull(rand.Reader, bundle[len(bundleMagic)+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	bundle = append(bundle, plain...)
+	bundle = bundle[:len(bundle)+bundleTagSize]
+	err = bundleCrypt(true, bundle, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// Unpack a bundle created by ExportRole() into basePath and add role to c with
+// that base path. basePath must not exist or be an empty directory. The
+// bundle is unpacked into a temporary directory next to basePath which is
+// renamed to basePath once the whole bundle has been unpacked, so a failed
+// import leaves no files behind. If the bundle was exported for a different
+// role or contains entries outside of basePath, ErrMalformedBundle is
+// returned. If passphrase is wrong or the bundle has been tampered with,
+// ErrWrongPassphrase is returned.
+func (c Context) ImportRole(role Role, basePath string, blob, passphrase []byte) error {
+	if len(blob) < bundleHeaderSize+bundleTagSize ||
+		string(blob[:len(bundleMagic)]) != bundleMagic ||
+		Role(blob[len(bundleMagic)]) != role {
+		return ErrMalformedBundle
+	}
+
+	bundle := append([]byte{}, blob...)
+	defer zero(bundle)
+
+	err := bundleCrypt(false, bundle, passphrase)
+	if err != nil {
+		return err
+	}
+
+	basePath = filepath.Clean(basePath)
+	parent := filepath.Dir(basePath)
+	err = os.MkdirAll(parent, 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(parent, "."+filepath.Base(basePath)+".import")
+	if err != nil {
+		return err
+	}
+
+	err = extractBundle(tmp, bundle[bundleHeaderSize:len(bundle)-bundleTagSize])
+	if err == nil {
+		err = os.Rename(tmp, basePath)
+	}
+
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	return c.AddRole(role, basePath)
+}
+
+// Unpack the tar archive plain into the directory dir. Entries are checked
+// after their names have been cleaned as filepath.Join() would clean them, so
+// no entry can end up outside of dir.
+func extractBundle(dir string, plain []byte) error {
+	tr := tar.NewReader(bytes.NewReader(plain))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return ErrMalformedBundle
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == "." || name == ".." ||
+			strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return ErrMalformedBundle
+		}
+
+		path := filepath.Join(dir, name)
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, mode)
+		case tar.TypeReg:
+			err = extractFile(path, mode, tr)
+		default:
+			err = ErrMalformedBundle
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Write the contents of r to a new file path with mode.
+func extractFile(path string, mode os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Encrypt or decrypt bundle in place with a key derived from passphrase. The
+// header of bundle must have been filled in and room for the tag must have
+// been left at its end.
+func bundleCrypt(encrypt bool, bundle, passphrase []byte) error {
+	err := initGcrypt()
+	if err != nil {
+		return err
+	}
+
+	salt := bundle[len(bundleMagic)+1 : len(bundleMagic)+1+bundleSaltSize]
+	nonce := bundle[bundleHeaderSize-bundleNonceSize : bundleHeaderSize]
+	body := bundle[bundleHeaderSize : len(bundle)-bundleTagSize]
+	tag := bundle[len(bundle)-bundleTagSize:]
+
+	key := (*[bundleKeySize]byte)(C.gcry_malloc_secure(bundleKeySize))
+	if key == nil {
+		return ErrSecMemExhausted
+	}
+
+	defer C.gcry_free(unsafe.Pointer(key))
+	defer zero(key[:])
+
+	var pwptr unsafe.Pointer
+	if len(passphrase) > 0 {
+		pwptr = unsafe.Pointer(&passphrase[0])
+	}
+
+	r := C.gcry_kdf_derive(pwptr, C.size_t(len(passphrase)),
+		C.GCRY_KDF_PBKDF2, C.GCRY_MD_SHA256,
+		unsafe.Pointer(&salt[0]), C.size_t(len(salt)), bundleIterations,
+		bundleKeySize, unsafe.Pointer(&key[0]))
+	if r != 0 {
+		return gcryptError(r)
+	}
+
+	var bodyptr unsafe.Pointer
+	if len(body) > 0 {
+		bodyptr = unsafe.Pointer(&body[0])
+	}
+
+	var encint C.int
+	if encrypt {
+		encint = 1
+	}
+
+	r = C.bundle_crypt(encint, unsafe.Pointer(&key[0]), unsafe.Pointer(&nonce[0]),
+		unsafe.Pointer(&bundle[0]), C.size_t(bundleHeaderSize),
+		bodyptr, C.size_t(len(body)), unsafe.Pointer(&tag[0]))
+	switch {
+	case r == 0:
+		return nil
+	case !encrypt && C.gcry_err_code(r) == C.GPG_ERR_CHECKSUM:
+		return ErrWrongPassphrase
+	default:
+		return gcryptError(r)
+	}
+}
+
+// Translate a libgcrypt error code into an error.
+func gcryptError(r C.gcry_error_t) error {
+	if C.gcry_err_code(r) == C.GPG_ERR_ENOMEM {
+		return ErrSecMemExhausted
+	}
+
+	return errors.New("openkey: " + C.GoString(C.gcry_strerror(r)))
+}
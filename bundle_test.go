@@ -0,0 +1,183 @@
+package openkey
+
+import "archive/tar"
+import "bytes"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+// An entry of a tar archive packed by makeBundle().
+type bundleEntry struct {
+	name string
+	data string
+}
+
+// Pack entries into a bundle for role encrypted with passphrase. Entries
+// whose name ends in a slash are directories.
+func makeBundle(t *testing.T, role Role, passphrase []byte, entries []bundleEntry) []byte {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0600, Typeflag: tar.TypeReg, Size: int64(len(e.data))}
+		if e.name[len(e.name)-1] == '/' {
+			hdr.Mode, hdr.Typeflag, hdr.Size = 0700, tar.TypeDir, 0
+		}
+
+		err := tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = tw.Write([]byte(e.data))
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := make([]byte, bundleHeaderSize, bundleHeaderSize+archive.Len()+bundleTagSize)
+	copy(bundle, bundleMagic)
+	bundle[len(bundleMagic)] = byte(role)
+	bundle = append(bundle, archive.Bytes()...)
+	bundle = bundle[:len(bundle)+bundleTagSize]
+	err = bundleCrypt(true, bundle, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bundle
+}
+
+// List the names of all files below dir.
+func listFiles(t *testing.T, dir string) []string {
+	var names []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		names = append(names, name)
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return names
+}
+
+func TestImportRole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	c, err := NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	passphrase := []byte("passphrase")
+	good := []bundleEntry{{"a/", ""}, {"a/b", "key"}}
+	base := filepath.Join(dir, "roles", "authenticator")
+	err = c.ImportRole(CardAuthenticator, base, makeBundle(t, CardAuthenticator, passphrase, good), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(base, "a", "b"))
+	if err != nil || string(data) != "key" {
+		t.Errorf("imported file reads %q, %v", data, err)
+	}
+
+	files := listFiles(t, filepath.Dir(base))
+	if len(files) != 3 {
+		t.Errorf("unexpected files after import: %q", files)
+	}
+}
+
+// Bundles that must be rejected without writing any file.
+func TestImportRoleMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []bundleEntry
+	}{
+		{"traversal", []bundleEntry{{"a/../../x", "escaped"}}},
+		{"parent", []bundleEntry{{"../x", "escaped"}}},
+		{"absolute", []bundleEntry{{"/x", "escaped"}}},
+		{"dot", []bundleEntry{{"./", ""}, {".", "x"}}},
+		{"after good entries", []bundleEntry{{"a/", ""}, {"a/b", "key"}, {"a/../../../x", "escaped"}}},
+	}
+
+	passphrase := []byte("passphrase")
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "openkey")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := NewContext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		base := filepath.Join(dir, "roles", "authenticator")
+		bundle := makeBundle(t, CardAuthenticator, passphrase, tt.entries)
+		err = c.ImportRole(CardAuthenticator, base, bundle, passphrase)
+		if err != ErrMalformedBundle {
+			t.Errorf("%s: got error %v, want ErrMalformedBundle", tt.name, err)
+		}
+
+		files := listFiles(t, dir)
+		if len(files) != 1 || files[0] != "roles" {
+			t.Errorf("%s: files left behind: %q", tt.name, files)
+		}
+
+		c.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// An import must not add to a base path that already contains files.
+func TestImportRoleExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	c, err := NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	err = ioutil.WriteFile(filepath.Join(dir, "existing"), nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passphrase := []byte("passphrase")
+	bundle := makeBundle(t, CardAuthenticator, passphrase, []bundleEntry{{"a", "key"}})
+	err = c.ImportRole(CardAuthenticator, dir, bundle, passphrase)
+	if err == nil {
+		t.Error("import into non-empty base path succeeded")
+	}
+
+	files := listFiles(t, dir)
+	if len(files) != 1 || files[0] != "existing" {
+		t.Errorf("unexpected files after failed import: %q", files)
+	}
+}
@@ -0,0 +1,236 @@
+package openkey
+
+import "github.com/clausecker/freefare"
+
+// Length of a card ID, a UUID in its usual textual representation, and of the
+// same ID as stored on the card, i.e. without dashes.
+const (
+	cardIDLength        = 36
+	mangledCardIDLength = 32
+)
+
+// The application ID of slot.
+func slotAid(slot int) freefare.DESFireAid {
+	return freefare.NewDESFireAid(uint32(BaseAID + slot))
+}
+
+// Make an AES key out of the first 16 bytes of key.
+func aesKey(key []byte) *freefare.DESFireKey {
+	var value [aesKeyLength]byte
+	copy(value[:], key)
+	return freefare.NewDESFireAESKey(value, 0)
+}
+
+// Find the slots of the openkey applications present on tag. This function
+// selects each application in turn as the application directory cannot be
+// listed without the PICC master key. tag must be connected.
+func openkeySlots(tag freefare.DESFireTag) ([]int, error) {
+	var slots []int
+	for slot := SlotMin; slot <= SlotMax; slot++ {
+		err := tag.SelectApplication(slotAid(slot))
+		if err == freefare.Error(freefare.ApplicationNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		slots = append(slots, slot)
+	}
+
+	return slots, nil
+}
+
+// Turn a card ID as stored on the card back into a UUID. This function
+// mirrors _unmangle_uuid() from libopenkey.c.
+func unmangleCardID(mangled []byte) (string, error) {
+	if len(mangled) != mangledCardIDLength {
+		return "", ErrMalformedCardID
+	}
+
+	id := make([]byte, 0, cardIDLength)
+	for i, b := range mangled {
+		switch i {
+		case 8, 12, 16, 20:
+			id = append(id, '-')
+		}
+
+		if !('0' <= b && b <= '9' || 'a' <= b && b <= 'f') {
+			return "", ErrMalformedCardID
+		}
+
+		id = append(id, b)
+	}
+
+	return string(id), nil
+}
+
+// Is id a card ID, i.e. a UUID in its textual representation? Upper case
+// digits are accepted.
+func isCardID(id string) bool {
+	if len(id) != cardIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		b := id[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if b != '-' {
+				return false
+			}
+
+			continue
+		}
+
+		if !('0' <= b && b <= '9' || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Read the card ID from the application of slot, authenticating with readKey.
+// tag must be connected.
+func readCardID(tag freefare.DESFireTag, slot int, readKey []byte) (string, error) {
+	err := tag.SelectApplication(slotAid(slot))
+	if err != nil {
+		return "", err
+	}
+
+	err = tag.Authenticate(1, *aesKey(readKey))
+	if err != nil {
+		return "", err
+	}
+
+	// The libfreefare may write MAC and padding past the end of the
+	// requested data, so leave some room for it.
+	buf := make([]byte, mangledCardIDLength, mangledCardIDLength+2*16+1)
+	tag.ReadSettings = freefare.Enciphered
+	tag.WriteSettings = freefare.Enciphered
+	n, err := tag.ReadData(1, 0, buf)
+	if err != nil {
+		return "", err
+	}
+
+	return unmangleCardID(buf[:n])
+}
+
+// Derive the key the application of slot on the card with the given ID is
+// authenticated with, i.e. key number 2. masterKey is the lock's master
+// authentication key. If pw is empty, the card is assumed to have no
+// password.
+func authenticationKey(masterKey []byte, slot int, cardID string, pw []byte) ([]byte, error) {
+	key := make([]byte, aesKeyLength)
+	aid := uint32(BaseAID + slot)
+
+	var err error
+	if len(pw) == 0 {
+		err = Kdf(masterKey, aid, 2, []byte(cardID), key)
+	} else {
+		err = Pbkdf(masterKey, aid, 2, []byte(cardID), pw, 0, key)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Figure out why the libopenkey could not authenticate tag. This function
+// returns ErrNotOpenkeyCard if tag has no openkey applications and
+// ErrWrongPassword along with the card ID if an application can be read with
+// the lock data ld but refuses the authentication key derived from pw. If the
+// reason cannot be determined, nil is returned. ld may be nil in which case the
+// password is not checked. tag must be inactive.
+func classifyAuthFailure(tag freefare.DESFireTag, ld *lockData, pw []byte) (string, error) {
+	if tag.Connect() != nil {
+		return "", nil
+	}
+
+	defer tag.Disconnect()
+
+	slots, err := openkeySlots(tag)
+	if err != nil {
+		return "", nil
+	}
+
+	if len(slots) == 0 {
+		return "", ErrNotOpenkeyCard
+	}
+
+	if ld == nil {
+		return "", nil
+	}
+
+	id, ok, err := checkPassword(tag, slots, ld, pw)
+	if err == nil && !ok {
+		return id, ErrWrongPassword
+	}
+
+	// the key is fine, communication failed, or the card is not ours
+	return "", nil
+}
+
+// Check whether the first application of slots that can be read with the lock
+// data ld accepts the authentication key derived from pw. The card ID read is
+// returned along with the result. If no application can be read,
+// ErrNotOpenkeyCard is returned. tag must be connected.
+func checkPassword(tag freefare.DESFireTag, slots []int, ld *lockData, pw []byte) (string, bool, error) {
+	for _, slot := range slots {
+		id, err := readCardID(tag, slot, ld.readKey[:])
+		if err != nil {
+			// not owned by our lock
+			continue
+		}
+
+		key, err := authenticationKey(ld.authenticationKey[:], slot, id, pw)
+		if err != nil {
+			return id, false, err
+		}
+
+		err = tag.Authenticate(2, *aesKey(key))
+		zero(key)
+		if _, ok := err.(freefare.Error); ok {
+			return id, false, nil
+		} else if err != nil {
+			return id, false, err
+		}
+
+		return id, true, nil
+	}
+
+	return "", false, ErrNotOpenkeyCard
+}
+
+// Overwrite b with zeroes.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Bring tag back into the state card operations expect it to be in: present
+// and inactive. See the package documentation for the tag lifecycle. Call
+// this function between two card operations on the same tag, e.g. when
+// authenticating and then owning a card in the same tap. If tag is still
+// active, e.g. because deselecting it failed at the end of the previous
+// operation, it is disconnected first. The tag is then selected again to make
+// sure it is still in the field and left inactive. If the tag cannot be
+// selected, the error from the libfreefare is returned; the card must then be
+// detected again with freefare.GetTags().
+func EnsureConnected(tag freefare.DESFireTag) error {
+	err := tag.Connect()
+	if err == freefare.Error(freefare.TagStateError) {
+		// still active from an earlier operation
+		tag.Disconnect()
+		err = tag.Connect()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tag.Disconnect()
+}
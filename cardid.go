@@ -0,0 +1,69 @@
+package openkey
+
+// #include <uuid/uuid.h>
+import "C"
+import "encoding/hex"
+import "strings"
+import "time"
+
+// Generate a new card ID the way the libopenkey does when creating a card: a
+// UUID from libuuid's uuid_generate() in lower case textual representation.
+// This allows assigning a card ID before the card is produced. An error is
+// only returned if libuuid yields something that is not a card ID.
+func NewCardID() (string, error) {
+	var uuid C.uuid_t
+	var buf [cardIDLength + 1]C.char
+
+	C.uuid_generate(&uuid[0])
+	C.uuid_unparse_lower(&uuid[0], &buf[0])
+	id := C.GoStringN(&buf[0], cardIDLength)
+	if !isCardID(id) {
+		return "", ErrMalformedCardID
+	}
+
+	return id, nil
+}
+
+// The components of a card ID as returned by DecodeCardID().
+type CardIDInfo struct {
+	UUID    [16]byte // the UUID in binary
+	Version int      // the UUID version, 4 (random) or 1 (time-based)
+
+	// for time-based UUIDs, the time the card ID was generated; the zero
+	// time otherwise
+	Time time.Time
+}
+
+// Offset between the UUID epoch, 1582-10-15, and the Unix epoch in units of
+// 100 ns.
+const uuidEpochOffset = 0x01b21dd213814000
+
+// Decode the card ID id into its components. Card IDs are UUIDs generated by
+// libuuid's uuid_generate() which yields random (version 4) UUIDs if a good
+// source of randomness is available and time-based (version 1) UUIDs
+// otherwise. Upper case digits are accepted. If id is not a card ID,
+// ErrMalformedCardID is returned.
+func DecodeCardID(id string) (CardIDInfo, error) {
+	var info CardIDInfo
+
+	if !isCardID(id) {
+		return info, ErrMalformedCardID
+	}
+
+	_, err := hex.Decode(info.UUID[:], []byte(strings.Replace(id, "-", "", -1)))
+	if err != nil {
+		return info, ErrMalformedCardID
+	}
+
+	info.Version = int(info.UUID[6] >> 4)
+	if info.Version == 1 {
+		u := info.UUID
+		ts := uint64(u[6]&0x0f)<<56 | uint64(u[7])<<48 | uint64(u[4])<<40 |
+			uint64(u[5])<<32 | uint64(u[0])<<24 | uint64(u[1])<<16 |
+			uint64(u[2])<<8 | uint64(u[3])
+		t := int64(ts) - uuidEpochOffset
+		info.Time = time.Unix(t/1e7, t%1e7*100).UTC()
+	}
+
+	return info, nil
+}
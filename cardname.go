@@ -0,0 +1,85 @@
+package openkey
+
+import "fmt"
+import "strings"
+
+// Number of digits of the serial number in a formatted card name.
+const serialDigits = 6
+
+// Check if s is non-empty and consists only of ASCII letters, digits, and
+// underscores. Such strings are stored unchanged by the libopenkey and can be
+// joined with dashes unambiguously.
+func isNameComponent(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		case b == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Format a card name of the form SITE-000123 from a site name and a serial
+// number. The serial number is zero-padded to six digits. site must be
+// non-empty and consist only of ASCII letters, digits, and underscores so the
+// libopenkey stores the name unchanged; n must be between 0 and 999999. If
+// these conditions are not met, ErrInvalidCardName is returned. The result can
+// be passed to ProducerCardCreate().
+func FormatCardName(site string, n int) (string, error) {
+	if !isNameComponent(site) || n < 0 || n > 999999 {
+		return "", ErrInvalidCardName
+	}
+
+	return fmt.Sprintf("%s-%0*d", site, serialDigits, n), nil
+}
+
+// The components of a card name of the form SITE-BLDG-000123 as parsed by
+// ParseCardName(). The components are joined with dashes rather than slashes
+// as the libopenkey replaces slashes in card names with underscores.
+type CardNameParts struct {
+	Site     string
+	Building string
+	Serial   int
+}
+
+// Split a card name of the form SITE-BLDG-000123 into its components. Site
+// and building must be non-empty and consist only of ASCII letters, digits,
+// and underscores, the serial number must consist of decimal digits. If name
+// is not of this form, ErrInvalidCardName is returned.
+func ParseCardName(name string) (CardNameParts, error) {
+	fields := strings.Split(name, "-")
+	if len(fields) != 3 || !isNameComponent(fields[0]) || !isNameComponent(fields[1]) {
+		return CardNameParts{}, ErrInvalidCardName
+	}
+
+	serial := fields[2]
+	if serial == "" || len(serial) > 9 {
+		return CardNameParts{}, ErrInvalidCardName
+	}
+
+	n := 0
+	for i := 0; i < len(serial); i++ {
+		if serial[i] < '0' || serial[i] > '9' {
+			return CardNameParts{}, ErrInvalidCardName
+		}
+
+		n = 10*n + int(serial[i]-'0')
+	}
+
+	return CardNameParts{fields[0], fields[1], n}, nil
+}
+
+// Format a card name from its components. This is the inverse of
+// ParseCardName(); the serial number is zero-padded to six digits. The
+// components are not checked, use ParseCardName() on the result to validate
+// it.
+func FormatCardNameParts(p CardNameParts) string {
+	return fmt.Sprintf("%s-%s-%0*d", p.Site, p.Building, serialDigits, p.Serial)
+}
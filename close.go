@@ -0,0 +1,78 @@
+package openkey
+
+import "sync"
+
+// What Close() does if card operations on the context are still in flight.
+type CloseMode int
+
+// Close modes
+const (
+	CloseWait CloseMode = iota // wait for the operations to finish
+	CloseFail                  // fail with ErrOperationsInFlight
+)
+
+// Choose what Close() does if card operations on c are still in flight, e.g.
+// an operation running on another goroutine or one abandoned after a timeout
+// that still continues in the background, see SetOperationTimeout(). With
+// CloseWait, the default, Close() waits until they have finished. With
+// CloseFail, Close() fails with ErrOperationsInFlight and leaves c open, so
+// call it again later. Card operations are ProducerCardCreate(),
+// ProducerCardRecreate(), ManagerOwnCard(), AuthenticateCard(), and their
+// variants. The setting is shared with the contexts cloned for a MultiReader,
+// but each of them only waits for its own operations.
+func (c Context) SetCloseMode(mode CloseMode) {
+	c.s.mu.Lock()
+	c.s.closeMode = mode
+	c.s.mu.Unlock()
+}
+
+// The card operations in flight on one C context.
+type operations struct {
+	mu sync.Mutex
+	n  int
+
+	// closed once n drops to 0, nil while n is 0
+	idle chan struct{}
+}
+
+// Record the start of a card operation.
+func (o *operations) begin() {
+	o.mu.Lock()
+	o.n++
+	if o.n == 1 {
+		o.idle = make(chan struct{})
+	}
+	o.mu.Unlock()
+}
+
+// Record the end of a card operation.
+func (o *operations) end() {
+	o.mu.Lock()
+	o.n--
+	if o.n == 0 {
+		close(o.idle)
+		o.idle = nil
+	}
+	o.mu.Unlock()
+}
+
+// Lock o once no operations are in flight, waiting for them to finish if wait
+// is set. If operations are in flight and wait is not set, o is not locked and
+// ErrOperationsInFlight is returned. Operations starting while o is locked
+// wait for it to be unlocked.
+func (o *operations) lockIdle(wait bool) error {
+	o.mu.Lock()
+	for o.n > 0 {
+		if !wait {
+			o.mu.Unlock()
+			return ErrOperationsInFlight
+		}
+
+		idle := o.idle
+		o.mu.Unlock()
+		<-idle
+		o.mu.Lock()
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package openkey
+
+import "encoding/csv"
+import "io"
+import "strconv"
+
+// Column headers of the CSV files written by WriteResultsCSV() and
+// WriteCommissionCSV().
+var (
+	resultsCSVHeader    = []string{"index", "card_id", "result", "error"}
+	commissionCSVHeader = []string{"reader", "card_id", "latency_ms", "result", "error"}
+)
+
+// Write the results of VerifyCards() to w as CSV for import into other
+// systems. The first line holds the column headers, followed by one line for
+// each result in order:
+//
+//	index    index of the card in the tags passed to VerifyCards()
+//	card_id  the card ID if known, empty otherwise
+//	result   "pass" or "fail"
+//	error    the error message for failed cards, empty otherwise
+//
+// Fields are quoted as described in RFC 4180. Errors from w are returned.
+func WriteResultsCSV(w io.Writer, results []VerifyResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write(resultsCSVHeader)
+	for i, r := range results {
+		result, msg := csvResult(r.Err)
+		cw.Write([]string{strconv.Itoa(i), r.CardID, result, msg})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Write the results of CommissionReaders() to w as CSV like
+// WriteResultsCSV(). The columns are:
+//
+//	reader      the connection string of the reader
+//	card_id     the ID of the card found if known, empty otherwise
+//	latency_ms  the time taken to authenticate the card in milliseconds,
+//	            empty if no card was found
+//	result      "pass" or "fail"
+//	error       the error message for failed readers, empty otherwise
+func WriteCommissionCSV(w io.Writer, results []CommissionResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write(commissionCSVHeader)
+	for _, r := range results {
+		latency := ""
+		if r.Latency > 0 {
+			latency = strconv.FormatFloat(r.Latency.Seconds()*1000, 'f', 3, 64)
+		}
+
+		result, msg := csvResult(r.Err)
+		cw.Write([]string{r.Connection, r.CardID, latency, result, msg})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Turn err into the result and error columns of a CSV line.
+func csvResult(err error) (string, string) {
+	if err != nil {
+		return "fail", err.Error()
+	}
+
+	return "pass", ""
+}
@@ -0,0 +1,324 @@
+package openkey
+
+import "encoding/hex"
+import "runtime"
+import "sync"
+
+import "github.com/clausecker/freefare"
+
+// Compute the application master key a producer writes into the application of
+// slot on a card with the given UID. masterKey is the producer's master key as
+// stored in its key store, uid is the card's real UID as returned by
+// RealCardUID(). This is the key required to authenticate with
+// key number 0 of the application with ID BaseAID + slot. If slot is out of
+// range, ErrInvalidSlot is returned.
+func ExpectedCardKey(uid []byte, masterKey []byte, slot int) ([]byte, error) {
+	if slot < SlotMin || slot > SlotMax {
+		return nil, ErrInvalidSlot
+	}
+
+	key := make([]byte, aesKeyLength)
+	err := Kdf(masterKey, uint32(BaseAID+slot), 0x00, uid, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Get the real UID of a card. The keys of an openkey card are diversified with
+// its real UID, but cards with random UID enabled (as the libopenkey does when
+// creating a card) present a different random UID during anti-collision each
+// time they are selected. freefare.Tag.UID() then returns that random UID
+// which is useless for key diversification.
+//
+// This function asks the card for its UID with the GetVersion command. If the
+// card answers with an all-zero UID because random UID is enabled, the real UID
+// is retrieved with the GetCardUID command instead. This requires that tag has
+// been authenticated with any key beforehand, e.g. the read key of an openkey
+// application. tag must be connected.
+func RealCardUID(tag freefare.DESFireTag) ([]byte, error) {
+	vi, err := tag.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range vi.UID {
+		if b != 0 {
+			return append([]byte{}, vi.UID[:]...), nil
+		}
+	}
+
+	uid, err := tag.CardUID()
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(uid)
+}
+
+// Get the UID of a card without authenticating, e.g. for logging before
+// deciding whether to authenticate. If the UID the card presented during
+// anti-collision is its real UID, that UID is returned along with true. Cards
+// with random UID enabled, such as those created by the libopenkey, instead
+// present a random UID of 4 bytes starting with 0x08. For these, the real UID
+// is asked for with the GetCardUID command, which only succeeds if tag is
+// connected and has been authenticated with tag.Authenticate() using any key of
+// the card; the card operations of this package disconnect from the tag when
+// done, ending the authentication. If the card refuses, the random UID is
+// returned along with false; the random UID changes each time the card is
+// selected. Errors are only returned for failures other than the card refusing
+// the command, e.g. if the card has left the field. Unlike RealCardUID(), tag
+// may be inactive.
+func CardUID(tag freefare.DESFireTag) ([]byte, bool, error) {
+	uid, err := hex.DecodeString(tag.UID())
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(uid) != 4 || uid[0] != 0x08 {
+		return uid, true, nil
+	}
+
+	realUID, err := tag.CardUID()
+	if _, ok := err.(freefare.Error); ok {
+		return uid, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	uid, err = hex.DecodeString(realUID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return uid, true, nil
+}
+
+// Return a fresh copy of key. Use this to keep a derived key beyond the
+// lifetime of the buffer it was derived into, e.g. if that buffer is reused for
+// the next derivation or cleared after use. The copy shares no memory with
+// key, so overwriting key afterwards does not affect it.
+func CloneKey(key []byte) []byte {
+	if key == nil {
+		return nil
+	}
+
+	return append([]byte{}, key...)
+}
+
+// The key to derive for an application by DeriveForApplications(). Length is
+// the length of the key in bytes; if it is 0, an AES key of 16 bytes is
+// derived.
+type AppKeySpec struct {
+	AID    uint32
+	KeyNo  byte
+	Length int
+}
+
+// Derive keys for multiple applications on a card from the same master key.
+// Like the keys of openkey applications, each key is derived with Kdf() using
+// the AID and key number of its application and the card's real UID as
+// diversification data. The keys are returned keyed by AID, so each AID may
+// only appear once in apps; otherwise ErrDuplicateAID is returned. On error,
+// the keys derived so far are zeroed before returning.
+func DeriveForApplications(masterKey, uid []byte, apps []AppKeySpec) (map[uint32][]byte, error) {
+	keys := make(map[uint32][]byte, len(apps))
+	for _, app := range apps {
+		if _, ok := keys[app.AID]; ok {
+			zeroKeys(keys)
+			return nil, ErrDuplicateAID
+		}
+
+		length := app.Length
+		if length == 0 {
+			length = aesKeyLength
+		}
+
+		key := make([]byte, length)
+		err := Kdf(masterKey, app.AID, app.KeyNo, uid, key)
+		if err != nil {
+			zero(key)
+			zeroKeys(keys)
+			return nil, err
+		}
+
+		keys[app.AID] = key
+	}
+
+	return keys, nil
+}
+
+// Overwrite every key in keys with zeroes.
+func zeroKeys(keys map[uint32][]byte) {
+	for _, key := range keys {
+		zero(key)
+	}
+}
+
+// A key to derive by DeriveKeysParallel(). The fields are the arguments to
+// Kdf() of the same name. Length is the length of the key in bytes; if it is
+// 0, an AES key of 16 bytes is derived.
+type KeySpec struct {
+	AID    uint32
+	KeyNo  byte
+	Data   []byte
+	Length int
+}
+
+// Derive many keys from the same master key with Kdf(), spreading the work
+// over workers goroutines. The keys are returned in the order of specs. If
+// workers is less than 1, runtime.GOMAXPROCS(0) goroutines are used. The
+// libgcrypt is initialized before the goroutines are started; from then on,
+// it is safe to use from multiple threads without thread callbacks, which the
+// libgcrypt ignores since version 1.6. masterKey is only read and may be
+// shared by all derivations. If a derivation fails, the keys derived so far
+// are overwritten and the error of the first failing spec in order is
+// returned. If the Length of any spec is negative, ErrInvalidArgument is
+// returned before any key is derived.
+func DeriveKeysParallel(masterKey []byte, specs []KeySpec, workers int) ([][]byte, error) {
+	for _, spec := range specs {
+		if spec.Length < 0 {
+			return nil, ErrInvalidArgument
+		}
+	}
+
+	err := initGcrypt()
+	if err != nil {
+		return nil, err
+	}
+
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	keys := make([][]byte, len(specs))
+	errs := make([]error, len(specs))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				length := specs[j].Length
+				if length == 0 {
+					length = aesKeyLength
+				}
+
+				key := make([]byte, length)
+				errs[j] = Kdf(masterKey, specs[j].AID, specs[j].KeyNo, specs[j].Data, key)
+				keys[j] = key
+			}
+		}()
+	}
+
+	for j := range specs {
+		jobs <- j
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			for _, key := range keys {
+				zero(key)
+			}
+
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// Types of DESFire keys DeriveDESFireKey() can derive.
+type KeyType int
+
+// Key types
+const (
+	KeyDES    KeyType = iota // single DES, 8 bytes
+	Key3DES                  // two-key triple DES, 16 bytes
+	Key3K3DES                // three-key triple DES, 24 bytes
+	KeyAES                   // AES-128, 16 bytes, as used by openkey
+)
+
+// Derive a key with Kdf() and turn it into a DESFire key of type keyType. The
+// key is derived with the length keyType requires; the derived bytes are
+// overwritten once the key has been constructed. The key version of DES keys
+// is taken from the derived bytes, that of AES keys is 0. An invalid keyType
+// yields ErrMalformedKey. Errors from Kdf() are returned.
+func DeriveDESFireKey(masterKey []byte, aid uint32, keyNo byte, data []byte, keyType KeyType) (freefare.DESFireKey, error) {
+	var des [8]byte
+	var des3 [16]byte
+	var des3k3 [24]byte
+	var aes [aesKeyLength]byte
+
+	var buf []byte
+	switch keyType {
+	case KeyDES:
+		buf = des[:]
+	case Key3DES:
+		buf = des3[:]
+	case Key3K3DES:
+		buf = des3k3[:]
+	case KeyAES:
+		buf = aes[:]
+	default:
+		return freefare.DESFireKey{}, ErrMalformedKey
+	}
+
+	defer zero(buf)
+
+	err := Kdf(masterKey, aid, keyNo, data, buf)
+	if err != nil {
+		return freefare.DESFireKey{}, err
+	}
+
+	switch keyType {
+	case KeyDES:
+		return *freefare.NewDESFireDESKey(des), nil
+	case Key3DES:
+		return *freefare.NewDESFire3DESKey(des3), nil
+	case Key3K3DES:
+		return *freefare.NewDESFire3K3DESKey(des3k3), nil
+	default:
+		return *freefare.NewDESFireAESKey(aes, 0), nil
+	}
+}
+
+// Lengths of the keys of each KeyType in bytes.
+var keyTypeLengths = [...]int{
+	KeyDES:    8,
+	Key3DES:   16,
+	Key3K3DES: 24,
+	KeyAES:    aesKeyLength,
+}
+
+// AID the PICC master key is derived for (MASTER_AID in libopenkey.c).
+const piccMasterAID = 0
+
+// Derive the PICC master key of a card with real UID uid from the producer's
+// master key masterKey, using the same parameters as the libopenkey: Kdf()
+// with AID 0, key number 0, and the UID as diversification data. The producer
+// sets the PICC master key of each card it writes to the key derived with
+// keyType KeyAES, so this key is needed to reformat a card, see
+// FactoryFormat(); the producer itself derives it automatically when
+// recreating cards. Other key types give keys of the same derivation but
+// different length for use outside the libopenkey. An invalid keyType yields
+// ErrMalformedKey.
+func DerivePICCMasterKey(masterKey []byte, uid []byte, keyType KeyType) ([]byte, error) {
+	if keyType < 0 || int(keyType) >= len(keyTypeLengths) {
+		return nil, ErrMalformedKey
+	}
+
+	key := make([]byte, keyTypeLengths[keyType])
+	err := Kdf(masterKey, piccMasterAID, 0, uid, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,282 @@
+package openkey
+
+import "github.com/clausecker/freefare"
+
+// Version of the card format written by this version of the libopenkey.
+const cardFormatV1 = 1
+
+// Diagnostic information about a card as gathered by DiagnoseCard(). Fields
+// that could not be retrieved are left at their zero value; the corresponding
+// errors are collected in Errors.
+type CardDiagnostics struct {
+	Version freefare.DESFireVersionInfo
+	FreeMem uint32 // free memory in bytes
+
+	// key settings and maximum number of keys of the PICC master key
+	PICCKeySettings, PICCMaxKeys byte
+
+	// the applications found on the card
+	Applications []ApplicationDiagnostics
+
+	// version of the openkey card format or 0 if not an openkey card
+	FormatVersion int
+
+	// errors that occured while gathering information, each a *StepError
+	Errors []error
+}
+
+// Diagnostic information about an application on a card.
+type ApplicationDiagnostics struct {
+	AID     uint32
+	Slot    int  // the openkey slot or -1 if not an openkey application
+	Openkey bool // whether this is an openkey application
+
+	KeySettings, MaxKeys byte
+}
+
+// Steps of DiagnoseCard()
+const (
+	StepVersion         = "get version"
+	StepFreeMem         = "get free memory"
+	StepPICCKeySettings = "get PICC key settings"
+	StepApplications    = "list applications"
+	StepKeySettings     = "get application key settings"
+)
+
+// Gather diagnostic information about a card for inclusion into a report.
+// The card is only read from, no authentication is performed. As cards
+// produced by the libopenkey do not allow listing their applications without
+// authentication, the openkey applications are looked for individually if the
+// listing fails; other applications are not found in that case. Failures to
+// gather individual pieces of information are recorded in the result rather
+// than returned. An error is only returned if the card cannot be connected to.
+// tag must be inactive.
+func DiagnoseCard(tag freefare.DESFireTag) (CardDiagnostics, error) {
+	var d CardDiagnostics
+
+	err := tag.Connect()
+	if err != nil {
+		return d, err
+	}
+
+	defer tag.Disconnect()
+
+	fail := func(step string, err error) {
+		d.Errors = append(d.Errors, &StepError{step, err})
+	}
+
+	d.Version, err = tag.Version()
+	if err != nil {
+		fail(StepVersion, err)
+	}
+
+	d.FreeMem, err = tag.FreeMem()
+	if err != nil {
+		fail(StepFreeMem, err)
+	}
+
+	err = tag.SelectApplication(freefare.NewDESFireAid(0))
+	if err == nil {
+		d.PICCKeySettings, d.PICCMaxKeys, err = tag.KeySettings()
+	}
+
+	if err != nil {
+		fail(StepPICCKeySettings, err)
+	}
+
+	aids, err := tag.ApplicationIds()
+	if err != nil {
+		fail(StepApplications, err)
+
+		slots, err := openkeySlots(tag)
+		if err != nil {
+			fail(StepApplications, err)
+		}
+
+		aids = nil
+		for _, slot := range slots {
+			aids = append(aids, slotAid(slot))
+		}
+	}
+
+	for _, aid := range aids {
+		ad := ApplicationDiagnostics{AID: aid.Aid(), Slot: -1}
+		if slot := int(ad.AID) - BaseAID; slot >= SlotMin && slot <= SlotMax {
+			ad.Slot = slot
+			ad.Openkey = true
+			d.FormatVersion = cardFormatV1
+		}
+
+		err = tag.SelectApplication(aid)
+		if err == nil {
+			ad.KeySettings, ad.MaxKeys, err = tag.KeySettings()
+		}
+
+		if err != nil {
+			fail(StepKeySettings, err)
+		}
+
+		d.Applications = append(d.Applications, ad)
+	}
+
+	return d, nil
+}
+
+// An application on a card as reported by CardApplications().
+type Application struct {
+	AID     uint32
+	Slot    int  // the openkey slot or -1 if not an openkey application
+	Openkey bool // whether this is an openkey application
+}
+
+// List the applications on a card, marking openkey applications. All openkey
+// applications are written by the producer and later owned by a manager
+// without changing their AID or key settings, so whether an application has
+// been owned cannot be told from the application list. As with DiagnoseCard(),
+// the openkey applications are looked for individually if the card does not
+// allow listing its applications without authentication; other applications
+// are not found in that case. tag must be inactive.
+func CardApplications(tag freefare.DESFireTag) ([]Application, error) {
+	err := tag.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tag.Disconnect()
+
+	aids, err := tag.ApplicationIds()
+	if err != nil {
+		slots, err := openkeySlots(tag)
+		if err != nil {
+			return nil, err
+		}
+
+		aids = nil
+		for _, slot := range slots {
+			aids = append(aids, slotAid(slot))
+		}
+	}
+
+	apps := make([]Application, len(aids))
+	for i, aid := range aids {
+		apps[i] = Application{AID: aid.Aid(), Slot: -1}
+		if slot := int(apps[i].AID) - BaseAID; slot >= SlotMin && slot <= SlotMax {
+			apps[i].Slot = slot
+			apps[i].Openkey = true
+		}
+	}
+
+	return apps, nil
+}
+
+// Find out the version of the openkey card format of a card. The libopenkey
+// has only ever written one card format, version 1, so every card carrying
+// openkey applications is reported as version 1; the version is not stored on
+// the card. If the card carries no openkey applications, ErrNotOpenkeyCard is
+// returned. tag must be inactive.
+func CardFormatVersion(tag freefare.DESFireTag) (int, error) {
+	err := tag.Connect()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tag.Disconnect()
+
+	slots, err := openkeySlots(tag)
+	if err != nil {
+		return 0, err
+	} else if len(slots) == 0 {
+		return 0, ErrNotOpenkeyCard
+	}
+
+	return cardFormatV1, nil
+}
+
+// Report whether a card has been written in an older card format than the one
+// this version of the libopenkey writes, so it should be rewritten with
+// ProducerCardRecreate(). As there is only one card format so far, this is
+// never the case for openkey cards. Errors are the same as for
+// CardFormatVersion(). tag must be inactive.
+func CardNeedsUpgrade(tag freefare.DESFireTag) (bool, error) {
+	version, err := CardFormatVersion(tag)
+	if err != nil {
+		return false, err
+	}
+
+	return version < cardFormatV1, nil
+}
+
+// Generations of Mifare DESFire cards as reported by CardCapabilities().
+const (
+	DESFireEV0 = iota // the original DESFire without AES support
+	DESFireEV1
+	DESFireEV2
+	DESFireEV3
+)
+
+// Capabilities of a card relevant to openkey as reported by
+// CardCapabilities().
+type CardCaps struct {
+	Generation  int    // DESFireEV0 to DESFireEV3
+	StorageSize int    // total storage in bytes, rounded down
+	FreeMem     uint32 // free memory in bytes
+
+	// Maximum number of applications on the card or -1 if only limited
+	// by memory. Generations before EV2 hold at most 28 applications.
+	MaxApplications int
+
+	// whether the card supports AES keys, which openkey requires
+	AES bool
+}
+
+// Maximum number of applications on DESFire cards before EV2.
+const maxApplicationsEV1 = 28
+
+// Determine the capabilities of a card. The generation and storage size are
+// taken from the card's hardware version, the free memory is queried. The
+// number of openkey slots a card can hold is limited by MaxApplications and
+// FreeMem; cards without AES support cannot hold openkey applications at all.
+// tag must be inactive.
+func CardCapabilities(tag freefare.DESFireTag) (CardCaps, error) {
+	err := tag.Connect()
+	if err != nil {
+		return CardCaps{}, err
+	}
+
+	defer tag.Disconnect()
+
+	vi, err := tag.Version()
+	if err != nil {
+		return CardCaps{}, err
+	}
+
+	free, err := tag.FreeMem()
+	if err != nil {
+		return CardCaps{}, err
+	}
+
+	caps := CardCaps{
+		FreeMem:         free,
+		MaxApplications: maxApplicationsEV1,
+		AES:             true,
+	}
+
+	switch major := vi.Hardware.VersionMajor; {
+	case major == 0:
+		caps.Generation = DESFireEV0
+		caps.AES = false
+	case major == 1:
+		caps.Generation = DESFireEV1
+	case major < 0x30:
+		caps.Generation = DESFireEV2
+		caps.MaxApplications = -1
+	default:
+		caps.Generation = DESFireEV3
+		caps.MaxApplications = -1
+	}
+
+	// the upper seven bits are the binary logarithm of the size
+	caps.StorageSize = 1 << (vi.Hardware.StorageSize >> 1)
+
+	return caps, nil
+}
@@ -0,0 +1,93 @@
+package openkey
+
+import "bytes"
+import "encoding/hex"
+import "fmt"
+import "io"
+
+import "github.com/clausecker/nfc/v2"
+
+// Write a human-readable report on the state of c to w for inclusion into a
+// support request. The report lists whether c is open, the roles added with
+// their base paths and bootstrap status, the producer fingerprint, the slots
+// of the manager, the versions of the libgcrypt and the libnfc linked, whether
+// the libgcrypt is in FIPS mode, and the result of CheckLinkage(). It never
+// contains key material; the producer fingerprint does not reveal the master
+// key. Information that cannot be gathered is reported along with the reason.
+// This function works on closed contexts and the zero Context, too. The report
+// is written to w with a single call; errors from w are returned. The format
+// of the report is not stable.
+func (c Context) Dump(w io.Writer) error {
+	var b bytes.Buffer
+
+	open := c.cptr != nil && *c.cptr != nil
+	if open {
+		fmt.Fprintln(&b, "openkey context: open")
+	} else {
+		fmt.Fprintln(&b, "openkey context: closed")
+	}
+
+	if c.s != nil {
+		c.dumpRoles(&b, open)
+	}
+
+	fmt.Fprintln(&b, "libraries:")
+	if err := initGcrypt(); err != nil {
+		fmt.Fprintf(&b, "\tlibgcrypt: %v\n", err)
+	} else if v, ok := gcryptVersion(); ok {
+		fmt.Fprintf(&b, "\tlibgcrypt %s, FIPS mode: %v\n", v, GcryptFIPSMode())
+	} else {
+		fmt.Fprintf(&b, "\tlibgcrypt initialized by the application, FIPS mode: %v\n",
+			GcryptFIPSMode())
+	}
+
+	fmt.Fprintf(&b, "\tlibnfc %s\n", nfc.Version())
+	if err := CheckLinkage(); err != nil {
+		fmt.Fprintf(&b, "\tlinkage: %v\n", err)
+	} else {
+		fmt.Fprintln(&b, "\tlinkage: ok")
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Write the part of the report of Dump() on the roles of c to b. open tells
+// whether c is still open.
+func (c Context) dumpRoles(b *bytes.Buffer, open bool) {
+	fmt.Fprintln(b, "roles:")
+
+	for role, name := range roleNames {
+		base, err := c.basePath(Role(role))
+		if err != nil {
+			fmt.Fprintf(b, "\t%s: not added\n", name)
+			continue
+		}
+
+		fmt.Fprintf(b, "\t%s: %s\n", name, base)
+		if !open {
+			continue
+		}
+
+		switch Role(role) {
+		case CardProducer:
+			fmt.Fprintf(b, "\t\tbootstrapped: %v\n", c.IsProducerBootstrapped())
+			if fp, err := c.ProducerFingerprint(); err != nil {
+				fmt.Fprintf(b, "\t\tfingerprint: %v\n", err)
+			} else {
+				fmt.Fprintf(b, "\t\tfingerprint: %s\n", hex.EncodeToString(fp))
+			}
+
+		case LockManager:
+			fmt.Fprintf(b, "\t\tbootstrapped: %v\n", c.IsManagerBootstrapped())
+			if slots, err := c.BootstrappedSlots(); err != nil {
+				fmt.Fprintf(b, "\t\tslots: %v\n", err)
+			} else {
+				fmt.Fprintf(b, "\t\tslots: %v\n", slots)
+			}
+
+		case CardAuthenticator:
+			fmt.Fprintf(b, "\t\tprepared: %v\n", c.PrepareAuthenticator())
+		}
+	}
+}
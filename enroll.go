@@ -0,0 +1,162 @@
+package openkey
+
+import "time"
+
+import "github.com/clausecker/freefare"
+
+// The result of a successful Enroll().
+type EnrollResult struct {
+	CardID string // the ID of the enrolled card
+	UID    []byte // the real UID of the card
+	Slot   int    // the slot the card was owned in or -1 if unknown
+
+	// how long producing, owning, and verifying the card took
+	Produce, Own, Verify time.Duration
+}
+
+// Register a new card in one go: produce the card with cardName, own it in
+// slot with password pw, and authenticate it once with pw to verify that it
+// works. c must have the producer, manager, and authenticator roles, the
+// former two bootstrapped (see ValidateProducerManagerCompatibility()). tag
+// must be inactive.
+//
+// keyFile is the transport key file to own the card with. Pass "" to use the
+// file the producer has just written for slot as given by
+// TransportKeyFilePath(); slot must then not be -1. If slot is -1, the
+// libopenkey picks a slot as ManagerOwnCard() does.
+//
+// Errors are returned as a *StepError naming the step that failed, one of
+// StepProduce, StepOwn, and StepVerify. The rollback semantics are as follows.
+// The real UID of the card is read before producing it, so it is known even
+// after the producer has enabled random UID. If reading it or
+// ProducerCardCreate() fails, nothing is rolled back: the card may be left
+// partially written, in which case ProducerCardRecreate() recovers it. If
+// anything after that fails, the card is restored to factory state with
+// FactoryFormat() using the PICC master key the producer derived for it. The
+// files written to the key stores are not rolled back: the entry in
+// ProducerLog(), the transport key files, the copy of keyFile in the manager's
+// key store, and, if owning succeeded, the entry in IssuedCards() remain as a
+// record of the failed enrollment. If the rollback fails as well, the card is
+// left as is and the *StepError is for StepRollback and wraps the error of the
+// rollback instead, so the card can be reset by hand. If ManagerOwnCard()
+// owned the card but returned a *LedgerError, the card is not rolled back but
+// verified; if that succeeds, res is filled in as on success, except that Slot
+// stays -1 if the libopenkey picked the slot, and a *StepError for StepOwn
+// wrapping the *LedgerError is returned.
+func (c Context) Enroll(tag freefare.DESFireTag, cardName string, slot int, keyFile string, pw []byte) (EnrollResult, error) {
+	res := EnrollResult{Slot: slot}
+
+	if keyFile == "" && slot == -1 {
+		return res, ErrInvalidSlot
+	}
+
+	// read the UID now: once produced, the card has random UID enabled and
+	// RealCardUID() would need an authentication we cannot do on rollback
+	start := time.Now()
+	err := tag.Connect()
+	if err != nil {
+		return res, &StepError{StepProduce, err}
+	}
+
+	res.UID, err = RealCardUID(tag)
+	tag.Disconnect()
+	if err != nil {
+		return res, &StepError{StepProduce, err}
+	}
+
+	err = c.ProducerCardCreate(tag, cardName)
+	res.Produce = time.Since(start)
+	if err != nil {
+		return res, &StepError{StepProduce, err}
+	}
+
+	if keyFile == "" {
+		keyFile, err = c.TransportKeyFilePath(res.UID, cardName, slot)
+		if err != nil {
+			return res, c.rollbackEnroll(tag, res.UID, StepOwn, err)
+		}
+	}
+
+	start = time.Now()
+	err = c.ManagerOwnCard(tag, slot, keyFile, pw)
+	res.Own = time.Since(start)
+	lerr, owned := err.(*LedgerError)
+	if err != nil && !owned {
+		return res, c.rollbackEnroll(tag, res.UID, StepOwn, err)
+	}
+
+	start = time.Now()
+	res.CardID, err = c.AuthenticateCard(tag, pw)
+	res.Verify = time.Since(start)
+	if err != nil {
+		res.CardID = ""
+		return res, c.rollbackEnroll(tag, res.UID, StepVerify, err)
+	}
+
+	if owned {
+		return res, &StepError{StepOwn, lerr}
+	}
+
+	if slot == -1 {
+		res.Slot = c.lastIssuedSlot(res.CardID)
+	}
+
+	return res, nil
+}
+
+// Steps of Enroll()
+const (
+	StepProduce  = "produce card"
+	StepOwn      = "own card"
+	StepVerify   = "verify card"
+	StepRollback = "roll back enrollment"
+)
+
+// Restore the card with real UID uid that failed enrollment in step with err
+// to factory state. Returns a *StepError for step and err if the rollback
+// succeeded, or for StepRollback and the rollback error otherwise.
+func (c Context) rollbackEnroll(tag freefare.DESFireTag, uid []byte, step string, err error) error {
+	base, rerr := c.basePath(CardProducer)
+	if rerr != nil {
+		return &StepError{StepRollback, rerr}
+	}
+
+	masterKey := make([]byte, aesKeyLength)
+	defer zero(masterKey)
+
+	rerr = readProducerKey(base, masterKey)
+	if rerr != nil {
+		return &StepError{StepRollback, rerr}
+	}
+
+	piccKey, rerr := DerivePICCMasterKey(masterKey, uid, KeyAES)
+	if rerr != nil {
+		return &StepError{StepRollback, rerr}
+	}
+
+	defer zero(piccKey)
+
+	rerr = FactoryFormat(tag, piccKey)
+	if rerr != nil {
+		return &StepError{StepRollback, rerr}
+	}
+
+	return &StepError{step, err}
+}
+
+// Find the slot the card with ID cardID was last recorded as issued in or -1
+// if it cannot be found.
+func (c Context) lastIssuedSlot(cardID string) int {
+	cards, err := c.IssuedCards()
+	if err != nil {
+		return -1
+	}
+
+	for i := len(cards) - 1; i >= 0; i-- {
+		if cards[i].CardID == cardID {
+			return cards[i].Slot
+		}
+	}
+
+	return -1
+}
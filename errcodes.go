@@ -0,0 +1,136 @@
+// Code generated by mkerrcodes.go from libopenkey.c; DO NOT EDIT.
+
+package openkey
+
+// Error codes returned by ProducerCardCreate(). Each constant is named after
+// the C function whose failure causes the error in _openkey_producer_card_create().
+// If that function is called more than once, the constants for the
+// second and later calls carry the number of the call in source order,
+// e.g. the suffix 2 for the second call. The message of each Error names
+// the step of the C function the call belongs to.
+const (
+	ErrCreateGcryCallocSecure     Error = 2
+	ErrCreateSanitizeCardName     Error = 3
+	ErrCreateConnect              Error = 4
+	ErrCreateGetVersion           Error = 5
+	ErrCreateRandomUID            Error = 6
+	ErrCreateUIDLength            Error = 46
+	ErrCreateOpenkeyKdf           Error = 7
+	ErrCreateOpenkeyKdf2          Error = 8
+	ErrCreateAESKeyNew            Error = 9
+	ErrCreateAESKeyNew2           Error = 10
+	ErrCreateAESKeyNew3           Error = 11
+	ErrCreateSelectApplication    Error = 12
+	ErrCreateAuthenticate         Error = 13
+	ErrCreateAIDNew               Error = 14
+	ErrCreateCreateApplicationAES Error = 15
+	ErrCreateSelectApplication2   Error = 16
+	ErrCreateAuthenticateAES      Error = 17
+	ErrCreateChangeKey            Error = 18
+	ErrCreateChangeKey2           Error = 19
+	ErrCreateChangeKey3           Error = 20
+	ErrCreateCreateStdDataFile    Error = 21
+	ErrCreateMangleUUID           Error = 22
+	ErrCreateWriteDataEx          Error = 23
+	ErrCreateChangeFileSettings   Error = 24
+	ErrCreateCreateStdDataFile2   Error = 25
+	ErrCreateChangeKey4           Error = 26
+	ErrCreateAuthenticateAES2     Error = 27
+	ErrCreateChangeKeySettings    Error = 28
+	ErrCreateSelectApplication3   Error = 29
+	ErrCreateAuthenticate2        Error = 30
+	ErrCreateChangeKeySettings2   Error = 47
+	ErrCreateChangeKey5           Error = 31
+	ErrCreateAuthenticateAES3     Error = 32
+	ErrCreateChangeKeySettings3   Error = 33
+	ErrCreateSetConfiguration     Error = 34
+	ErrCreateMalloc               Error = 35
+	ErrCreateSnprintf             Error = 36
+	ErrCreateSnprintf2            Error = 37
+	ErrCreateEnsureDirectory      Error = 38
+	ErrCreateFopenInDir           Error = 39
+	ErrCreateFprintf              Error = 40
+	ErrCreateFprintf2             Error = 41
+	ErrCreateFprintf3             Error = 42
+	ErrCreateFprintf4             Error = 43
+	ErrCreateFopenInDir2          Error = 44
+	ErrCreateFprintf5             Error = 45
+)
+
+// The origins of the error codes returned by ProducerCardCreate().
+var createErrors = map[Error]errorOrigin{
+	ErrCreateGcryCallocSecure:     {"gcry_calloc_secure", false, "gcry_calloc_secure() failed"},
+	ErrCreateSanitizeCardName:     {"_sanitize_card_name", false, "_sanitize_card_name() failed"},
+	ErrCreateConnect:              {"mifare_desfire_connect", true, "connect: mifare_desfire_connect() failed"},
+	ErrCreateGetVersion:           {"mifare_desfire_get_version", true, "read UID: mifare_desfire_get_version() failed"},
+	ErrCreateRandomUID:            {"memcmp", false, "read UID: random UID is already enabled"},
+	ErrCreateUIDLength:            {"", false, "read UID: UID is too long"},
+	ErrCreateOpenkeyKdf:           {"openkey_kdf", false, "derive all derived keys: openkey_kdf() failed"},
+	ErrCreateOpenkeyKdf2:          {"openkey_kdf", false, "derive all derived keys: openkey_kdf() failed"},
+	ErrCreateAESKeyNew:            {"mifare_desfire_aes_key_new", false, "write the card: mifare_desfire_aes_key_new() failed"},
+	ErrCreateAESKeyNew2:           {"mifare_desfire_aes_key_new", false, "write the card: mifare_desfire_aes_key_new() failed"},
+	ErrCreateAESKeyNew3:           {"mifare_desfire_aes_key_new", false, "create and write each application: mifare_desfire_aes_key_new() failed"},
+	ErrCreateSelectApplication:    {"mifare_desfire_select_application", true, "create and write each application: mifare_desfire_select_application() failed"},
+	ErrCreateAuthenticate:         {"mifare_desfire_authenticate", true, "create and write each application: mifare_desfire_authenticate() failed"},
+	ErrCreateAIDNew:               {"mifare_desfire_aid_new", false, "create and write each application: mifare_desfire_aid_new() failed"},
+	ErrCreateCreateApplicationAES: {"mifare_desfire_create_application_aes", true, "create and write each application: mifare_desfire_create_application_aes() failed"},
+	ErrCreateSelectApplication2:   {"mifare_desfire_select_application", true, "create and write each application: mifare_desfire_select_application() failed"},
+	ErrCreateAuthenticateAES:      {"mifare_desfire_authenticate_aes", true, "create and write each application: mifare_desfire_authenticate_aes() failed"},
+	ErrCreateChangeKey:            {"mifare_desfire_change_key", true, "create and write each application: mifare_desfire_change_key() failed"},
+	ErrCreateChangeKey2:           {"mifare_desfire_change_key", true, "create and write each application: mifare_desfire_change_key() failed"},
+	ErrCreateChangeKey3:           {"mifare_desfire_change_key", true, "create and write each application: mifare_desfire_change_key() failed"},
+	ErrCreateCreateStdDataFile:    {"mifare_desfire_create_std_data_file", true, "create and write each application: mifare_desfire_create_std_data_file() failed"},
+	ErrCreateMangleUUID:           {"_mangle_uuid", false, "create and write each application: _mangle_uuid() failed"},
+	ErrCreateWriteDataEx:          {"mifare_desfire_write_data_ex", true, "create and write each application: mifare_desfire_write_data_ex() failed"},
+	ErrCreateChangeFileSettings:   {"mifare_desfire_change_file_settings", true, "create and write each application: mifare_desfire_change_file_settings() failed"},
+	ErrCreateCreateStdDataFile2:   {"mifare_desfire_create_std_data_file", true, "create and write each application: mifare_desfire_create_std_data_file() failed"},
+	ErrCreateChangeKey4:           {"mifare_desfire_change_key", true, "create and write each application: mifare_desfire_change_key() failed"},
+	ErrCreateAuthenticateAES2:     {"mifare_desfire_authenticate_aes", true, "create and write each application: mifare_desfire_authenticate_aes() failed"},
+	ErrCreateChangeKeySettings:    {"mifare_desfire_change_key_settings", true, "create and write each application: mifare_desfire_change_key_settings() failed"},
+	ErrCreateSelectApplication3:   {"mifare_desfire_select_application", true, "change master key and PICC settings: mifare_desfire_select_application() failed"},
+	ErrCreateAuthenticate2:        {"mifare_desfire_authenticate", true, "change master key and PICC settings: mifare_desfire_authenticate() failed"},
+	ErrCreateChangeKeySettings2:   {"mifare_desfire_change_key_settings", true, "change master key and PICC settings: mifare_desfire_change_key_settings() failed"},
+	ErrCreateChangeKey5:           {"mifare_desfire_change_key", true, "change master key and PICC settings: mifare_desfire_change_key() failed"},
+	ErrCreateAuthenticateAES3:     {"mifare_desfire_authenticate_aes", true, "change master key and PICC settings: mifare_desfire_authenticate_aes() failed"},
+	ErrCreateChangeKeySettings3:   {"mifare_desfire_change_key_settings", true, "change master key and PICC settings: mifare_desfire_change_key_settings() failed"},
+	ErrCreateSetConfiguration:     {"mifare_desfire_set_configuration", true, "change master key and PICC settings: mifare_desfire_set_configuration() failed"},
+	ErrCreateMalloc:               {"malloc", false, "write the transport key files: malloc() failed"},
+	ErrCreateSnprintf:             {"snprintf", false, "write the transport key files: snprintf() failed"},
+	ErrCreateSnprintf2:            {"snprintf", false, "write the transport key files: snprintf() failed"},
+	ErrCreateEnsureDirectory:      {"_ensure_directory", false, "write the transport key files: _ensure_directory() failed"},
+	ErrCreateFopenInDir:           {"_fopen_in_dir", false, "write the transport key files: _fopen_in_dir() failed"},
+	ErrCreateFprintf:              {"fprintf", false, "write the transport key files: fprintf() failed"},
+	ErrCreateFprintf2:             {"fprintf", false, "write the transport key files: fprintf() failed"},
+	ErrCreateFprintf3:             {"fprintf", false, "write the transport key files: fprintf() failed"},
+	ErrCreateFprintf4:             {"fprintf", false, "write the transport key files: fprintf() failed"},
+	ErrCreateFopenInDir2:          {"_fopen_in_dir", false, "write the transport key files: _fopen_in_dir() failed"},
+	ErrCreateFprintf5:             {"fprintf", false, "write the transport key files: fprintf() failed"},
+}
+
+// Error codes returned by ManagerOwnCard(). Each constant is named after
+// the C function whose failure causes the error in openkey_manager_card_own_pw().
+// If that function is called more than once, the constants for the
+// second and later calls carry the number of the call in source order,
+// e.g. the suffix 2 for the second call. The message of each Error names
+// the step of the C function the call belongs to.
+const (
+	ErrOwnLoadTransportData Error = 2
+	ErrOwnCopyTransportFile Error = 3
+	ErrOwnConnect           Error = 4
+)
+
+// The origins of the error codes returned by ManagerOwnCard().
+var ownErrors = map[Error]errorOrigin{
+	ErrOwnLoadTransportData: {"_load_transport_data", false, "_load_transport_data() failed"},
+	ErrOwnCopyTransportFile: {"_copy_transport_file", false, "_copy_transport_file() failed"},
+	ErrOwnConnect:           {"mifare_desfire_connect", true, "mifare_desfire_connect() failed"},
+}
+
+// The tables of error origins by the function returning the codes.
+var errorTables = []struct {
+	function string
+	origins  map[Error]errorOrigin
+}{
+	{"ProducerCardCreate", createErrors},
+	{"ManagerOwnCard", ownErrors},
+}
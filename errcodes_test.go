@@ -0,0 +1,81 @@
+package openkey
+
+import "bytes"
+import "io/ioutil"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strings"
+import "testing"
+
+// errcodes.go must be what mkerrcodes.go generates from libopenkey.c.
+func TestErrcodesUpToDate(t *testing.T) {
+	gocmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+
+	dir, err := ioutil.TempDir("", "openkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"mkerrcodes.go", "libopenkey.c"} {
+		data, err := ioutil.ReadFile(name)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command(gocmd, "run", "mkerrcodes.go")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("mkerrcodes.go failed: %v\n%s", err, out)
+	}
+
+	want, err := ioutil.ReadFile(filepath.Join(dir, "errcodes.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile("errcodes.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Error("errcodes.go is out of date, run go generate")
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	tests := []struct {
+		err   Error
+		parts []string
+	}{
+		{ErrCreateChangeKey5, []string{"#31", "ProducerCardCreate: change master key and PICC settings: mifare_desfire_change_key() failed"}},
+		{ErrCreateRandomUID, []string{"#6", "random UID is already enabled"}},
+		{ErrOwnConnect, []string{"ProducerCardCreate: connect: mifare_desfire_connect() failed", "ManagerOwnCard: mifare_desfire_connect() failed"}},
+	}
+
+	for _, tt := range tests {
+		msg := tt.err.Error()
+		for _, part := range tt.parts {
+			if !strings.Contains(msg, part) {
+				t.Errorf("message of error %d %q lacks %q", int(tt.err), msg, part)
+			}
+		}
+	}
+
+	if msg := Error(99).Error(); msg != "openkey error #99" {
+		t.Errorf("unknown error code described as %q", msg)
+	}
+}
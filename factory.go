@@ -0,0 +1,66 @@
+package openkey
+
+import "github.com/clausecker/freefare"
+
+// PICC key settings of a card in factory state: the master key can be changed,
+// applications can be listed and created without authentication, and the
+// settings themselves can be changed.
+const factoryPICCSettings = 0x0f
+
+// Restore a card to its factory state. All applications on the card are
+// deleted, openkey or not, the PICC key settings are reset, and the PICC
+// master key is changed back to the default DES key of all zeroes.
+//
+// currentMasterKey is the card's current PICC master key. A 16 byte key is
+// used as an AES key like the one the libopenkey writes to the cards it
+// produces (see DerivePICCMasterKey()), an 8 byte key as a DES key. Pass nil
+// if the card still has the default key. Keys of other lengths yield
+// ErrMalformedKey. Errors from the tag are returned as is. A wrong key leaves
+// the card unchanged; if resetting the master key fails after formatting, the
+// card is left empty with its old master key. tag must be inactive.
+func FactoryFormat(tag freefare.DESFireTag, currentMasterKey []byte) error {
+	var key *freefare.DESFireKey
+	switch len(currentMasterKey) {
+	case 0:
+		key = freefare.NewDESFireDESKey([8]byte{})
+	case 8:
+		var value [8]byte
+		copy(value[:], currentMasterKey)
+		key = freefare.NewDESFireDESKey(value)
+	case aesKeyLength:
+		key = aesKey(currentMasterKey)
+	default:
+		return ErrMalformedKey
+	}
+
+	err := tag.Connect()
+	if err != nil {
+		return err
+	}
+
+	defer tag.Disconnect()
+
+	err = tag.SelectApplication(freefare.NewDESFireAid(0))
+	if err != nil {
+		return err
+	}
+
+	err = tag.Authenticate(0, *key)
+	if err != nil {
+		return err
+	}
+
+	err = tag.FormatPICC()
+	if err != nil {
+		return err
+	}
+
+	// openkey cards do not allow changing the PICC master key unless the
+	// key settings are changed first
+	err = tag.ChangeKeySettings(factoryPICCSettings)
+	if err != nil {
+		return err
+	}
+
+	return tag.ChangeKey(0, *freefare.NewDESFireDESKey([8]byte{}), *key)
+}
@@ -2,4 +2,7 @@ module github.com/clausecker/openkey
 
 go 1.12
 
-require github.com/clausecker/freefare v0.4.0
+require (
+	github.com/clausecker/freefare v0.4.0
+	github.com/clausecker/nfc/v2 v2.1.4
+)
@@ -0,0 +1,157 @@
+package openkey
+
+import "bufio"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "time"
+
+import "github.com/clausecker/freefare"
+
+// An entry in the list of cards a manager has issued. ManagerOwnCard() appends
+// an entry to the list each time it successfully owns a card.
+//
+// The list is kept in the file "issued" in the manager's base path. It is a
+// text file with one line per card of the form
+//
+//	2006-01-02T15:04:05Z 3 0ff2a8c4-8e3b-4f2c-9c3d-6a1e2f3b4c5d
+//
+// i.e. the time the card was owned in RFC 3339 format and UTC, the slot the
+// card was owned in, and the card ID, separated by single spaces. If the slot
+// could not be determined, it is recorded as -1.
+type IssuedCard struct {
+	Time   time.Time // when the card was owned
+	Slot   int       // the slot the card was owned in or -1 if unknown
+	CardID string    // the card ID as returned by AuthenticateCard()
+}
+
+// Read the list of cards the manager has issued. The entries are returned in
+// the order they were written. If no cards have been issued yet, an empty slice
+// is returned. If the manager role has not been added to c, ErrRoleNotAdded is
+// returned. Malformed entries yield ErrMalformedLog.
+func (c Context) IssuedCards() ([]IssuedCard, error) {
+	base, err := c.basePath(LockManager)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(base, issuedLogName))
+	if os.IsNotExist(err) {
+		return []IssuedCard{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	cards := []IssuedCard{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), " ")
+		if len(fields) != 3 || len(fields[2]) != cardIDLength {
+			return nil, ErrMalformedLog
+		}
+
+		t, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil {
+			return nil, ErrMalformedLog
+		}
+
+		slot, err := strconv.Atoi(fields[1])
+		if err != nil || slot != -1 && (slot < SlotMin || slot > SlotMax) {
+			return nil, ErrMalformedLog
+		}
+
+		cards = append(cards, IssuedCard{t, slot, fields[2]})
+	}
+
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+
+	return cards, nil
+}
+
+// Returned by ManagerOwnCard() if the card has been owned, but could not be
+// recorded in the list of issued cards. The card is owned and ready for use;
+// do not retry owning it or roll it back. Err is the error recording the card
+// failed with.
+type LedgerError struct {
+	Err error
+}
+
+// Returns a string of the form "openkey: card owned but not recorded: error".
+func (e *LedgerError) Error() string {
+	return "openkey: card owned but not recorded: " + e.Err.Error()
+}
+
+// Return the error recording the card failed with.
+func (e *LedgerError) Unwrap() error {
+	return e.Err
+}
+
+// Append the card owned with the transport key file keyFile to the list of
+// issued cards. slot is the slot the card was owned in or -1 if the libopenkey
+// picked one, in which case the slot is looked up on tag.
+func (c Context) recordIssued(tag freefare.DESFireTag, slot int, keyFile string) error {
+	base, err := c.basePath(LockManager)
+	if err != nil {
+		return err
+	}
+
+	td, err := readTransportData(keyFile)
+	if err != nil {
+		return err
+	}
+
+	if slot == -1 {
+		slot = ownedSlot(tag, base, td.cardID)
+	}
+
+	f, err := os.OpenFile(filepath.Join(base, issuedLogName),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%s %d %s\n",
+		Now().UTC().Format(time.RFC3339), slot, td.cardID)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Find the slot the card with ID cardID has been owned in by the manager with
+// base path base. If the slot cannot be found, -1 is returned. tag must be
+// inactive.
+func ownedSlot(tag freefare.DESFireTag, base, cardID string) int {
+	ld, err := readLockData(base)
+	if err != nil || ld == nil {
+		return -1
+	}
+
+	if tag.Connect() != nil {
+		return -1
+	}
+
+	defer tag.Disconnect()
+
+	slots, err := openkeySlots(tag)
+	if err != nil {
+		return -1
+	}
+
+	for _, slot := range slots {
+		id, err := readCardID(tag, slot, ld.readKey[:])
+		if err == nil && id == cardID {
+			return slot
+		}
+	}
+
+	return -1
+}
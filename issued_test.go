@@ -0,0 +1,65 @@
+package openkey
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+import "github.com/clausecker/freefare"
+
+// The list of issued cards must be private to the manager like the rest of its
+// key store.
+func TestRecordIssued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	c, err := NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	err = c.AddRole(LockManager, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "transport")
+	err = ioutil.WriteFile(keyFile, []byte(testTransportKeyFile), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.recordIssued(freefare.DESFireTag{}, 3, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, issuedLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("list of issued cards created with mode %#o, want 0600", perm)
+	}
+
+	err = c.CheckKeyPermissions(LockManager)
+	if err != nil {
+		t.Errorf("CheckKeyPermissions: %v", err)
+	}
+
+	cards, err := c.IssuedCards()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cards) != 1 || cards[0].Slot != 3 || cards[0].CardID != "0ff2a8c4-5d1e-4b6a-9c3f-7e2d8a1b6c40" {
+		t.Errorf("unexpected issued cards %+v", cards)
+	}
+}
@@ -0,0 +1,69 @@
+package openkey
+
+import "bytes"
+import "encoding/hex"
+
+// Known answers for Kdf() used by KdfMatchesUpstream(). The derived keys have
+// been captured by calling openkey_kdf() from libopenkey.c as imported into
+// this repository from upstream, before any local changes, built as a
+// standalone program against libgcrypt 1.10.1. They agree with upstream's
+// definition of the scheme: HMAC-SHA256 keyed with the master key over the low
+// three bytes of the AID in little endian, the key number, and the data,
+// truncated to the length of the key.
+var kdfVectors = []struct {
+	masterKey string
+	aid       uint32
+	keyNo     byte
+	data      string
+	derived   string
+}{
+	// application keys of slots 0 and 1 for a 7 byte UID
+	{"000102030405060708090a0b0c0d0e0f", BaseAID, 0, "04a1b2c3d4e580",
+		"38c9a58ef36998e537e16183e2d10b84"},
+	{"000102030405060708090a0b0c0d0e0f", BaseAID + 1, 0, "04a1b2c3d4e580",
+		"886354a3dcb38812c7ed30af42279fc9"},
+
+	// another key number
+	{"000102030405060708090a0b0c0d0e0f", BaseAID, 2, "04a1b2c3d4e580",
+		"85961e910a035e5778ae50239c2de11f"},
+
+	// long master key, a card ID as data, full length output
+	{"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", 0xff77ff, 1,
+		hex.EncodeToString([]byte("0ff2a8c4-5d1e-4b6a-9c3f-7e2d8a1b6c40")),
+		"a0e427fbe249a03877c6ec7733e1e98c8713e873f6255fd12c269e76277acb0e"},
+
+	// odd AID and key number, one byte of data, 24 byte output
+	{"ffffffffffffffffffffffffffffffff", 0x000001, 0x0d, "00",
+		"fc83406eb4a14f91f2facb2dab781d871cde5fc3803fcfe2"},
+	{"2b7e151628aed2a6abf7158809cf4f3c", 0x123456, 0x7f,
+		"6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51",
+		"cd496af449231a890c00b6c4f60edefa"},
+
+	// authentication key of slot 5 for a card without a password
+	{"00112233445566778899aabbccddeeff", BaseAID + 5, 2,
+		hex.EncodeToString([]byte("3f2504e0-4f89-41d3-9a0c-0305e82c3301")),
+		"f65f70be94257e21d4e7f68e2737259b"},
+}
+
+// Check that Kdf() derives the same keys as upstream's libopenkey does. The
+// libopenkey shipped with these bindings is checked against a set of known
+// answers covering different master key lengths, AIDs, key numbers, data, and
+// key lengths. If it has drifted from upstream, cards written with these
+// bindings cannot be used with other openkey deployments and vice versa, so
+// consider this a fatal error. If Kdf() fails, e.g. because the libgcrypt
+// cannot be initialized, false is returned, too.
+func KdfMatchesUpstream() bool {
+	for _, v := range kdfVectors {
+		masterKey, _ := hex.DecodeString(v.masterKey)
+		data, _ := hex.DecodeString(v.data)
+		want, _ := hex.DecodeString(v.derived)
+
+		key := make([]byte, len(want))
+		err := Kdf(masterKey, v.aid, v.keyNo, data, key)
+		if err != nil || !bytes.Equal(key, want) {
+			return false
+		}
+	}
+
+	return true
+}
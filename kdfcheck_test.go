@@ -0,0 +1,36 @@
+package openkey
+
+import "bytes"
+import "encoding/hex"
+import "testing"
+
+func TestKdfMatchesUpstream(t *testing.T) {
+	for i, v := range kdfVectors {
+		masterKey, err := hex.DecodeString(v.masterKey)
+		if err != nil {
+			t.Fatalf("vector %d: master key: %v", i, err)
+		}
+
+		data, err := hex.DecodeString(v.data)
+		if err != nil {
+			t.Fatalf("vector %d: data: %v", i, err)
+		}
+
+		want, err := hex.DecodeString(v.derived)
+		if err != nil {
+			t.Fatalf("vector %d: derived key: %v", i, err)
+		}
+
+		key := make([]byte, len(want))
+		err = Kdf(masterKey, v.aid, v.keyNo, data, key)
+		if err != nil {
+			t.Errorf("vector %d: %v", i, err)
+		} else if !bytes.Equal(key, want) {
+			t.Errorf("vector %d: got %x, want %x", i, key, want)
+		}
+	}
+
+	if !KdfMatchesUpstream() {
+		t.Error("KdfMatchesUpstream() reports a mismatch")
+	}
+}
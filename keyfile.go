@@ -0,0 +1,222 @@
+package openkey
+
+// #include <stdlib.h>
+import "C"
+import "bufio"
+import "io"
+import "strconv"
+import "strings"
+import "unsafe"
+
+// The type of a key file written by the libopenkey.
+type KeyFileType int
+
+// Key file types
+const (
+	ProducerKeyFile  KeyFileType = iota // "producer" of a producer
+	ManagerKeyFile                      // "manager" of a manager
+	LockKeyFile                         // "lock" of a manager or authenticator
+	TransportKeyFile                    // transport key file of an application
+)
+
+// Prefixes of the first lines of the key files, each followed by the version
+// of the format.
+var keyFileMagicPrefixes = [...]string{
+	ProducerKeyFile:  producerMagicPrefix,
+	ManagerKeyFile:   managerMagicPrefix,
+	LockKeyFile:      lockMagicPrefix,
+	TransportKeyFile: transportMagicPrefix,
+}
+
+// Maximum number of slots read from a lock key file, the size of slot_list in
+// struct lock_data of the libopenkey.
+const maxLockSlots = 16 + 1
+
+// Number of AES keys stored in each type of key file.
+var keyFileKeys = [...]int{
+	ProducerKeyFile:  1, // master key
+	ManagerKeyFile:   1, // master authenticity update key
+	LockKeyFile:      2, // read key, master authentication key
+	TransportKeyFile: 3, // read, authentication, and update key
+}
+
+// The structure of a key file as returned by ParseKeyFile(). The keys
+// themselves are not returned.
+type KeyFile struct {
+	Type    KeyFileType
+	Version int
+
+	// number of AES keys present
+	Keys int
+
+	// whether the ECDSA key pair of the manager is present, i.e. the
+	// private key in a manager key file or the public key in a lock key
+	// file; key files written by old versions of the libopenkey lack it
+	ECDSAKey bool
+
+	// slots to try in order as stored in a lock key file, -1 meaning "all
+	// remaining slots"
+	Slots []int
+
+	// card name (sanitized) and card ID stored in a transport key file
+	CardName string
+	CardID   string
+}
+
+// Parse a key file as the libopenkey writes it under the base paths of its
+// roles, i.e. a producer, manager, or lock key file or a transport key file.
+// The type of the key file is determined from its first line. The keys are
+// checked to be well-formed but are not returned. The ECDSA keys are not
+// checked beyond their presence. Only the lines the libopenkey reads are
+// examined, trailing data is ignored. If the first line is not that of a key
+// file, or the file is truncated or otherwise malformed, ErrMalformedKey is
+// returned. For key files of a version other than 1, the type and version are
+// returned along with ErrKeyFileVersion. Errors from reading r are returned as
+// is. This function does not need a context and can be used on any input,
+// including untrusted input.
+//
+// The slots of a lock key file are read as the libopenkey reads them: numbers
+// as understood by strtol() with base 0 are read one after another until one
+// cannot be read, ignoring the rest of the line, so "3 x" yields slot 3. Each
+// number must be -1 or a valid slot. If there are none, the list is -1.
+func ParseKeyFile(r io.Reader) (KeyFile, error) {
+	return parseKeyFile(r, nil)
+}
+
+// Implementation of ParseKeyFile(). The keys read are stored into the
+// corresponding elements of keys, each of which must be aesKeyLength bytes
+// long. Keys beyond the end of keys are checked and discarded.
+func parseKeyFile(r io.Reader, keys [][]byte) (KeyFile, error) {
+	var kf KeyFile
+
+	s := bufio.NewScanner(r)
+	next := func() (string, error) {
+		if s.Scan() {
+			return s.Text(), nil
+		} else if s.Err() != nil {
+			return "", s.Err()
+		}
+
+		return "", ErrMalformedKey
+	}
+
+	line, err := next()
+	if err != nil {
+		return kf, err
+	}
+
+	found := false
+	for t, prefix := range keyFileMagicPrefixes {
+		if strings.HasPrefix(line, prefix) {
+			kf.Type = KeyFileType(t)
+			line = line[len(prefix):]
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return kf, ErrMalformedKey
+	}
+
+	kf.Version, err = strconv.Atoi(line)
+	if err != nil || kf.Version < 1 {
+		return KeyFile{}, ErrMalformedKey
+	} else if kf.Version != 1 {
+		return kf, ErrKeyFileVersion
+	}
+
+	switch kf.Type {
+	case LockKeyFile:
+		line, err = next()
+		if err != nil {
+			return kf, err
+		}
+
+		kf.Slots, err = parseSlots(line)
+		if err != nil {
+			return kf, err
+		}
+
+	case TransportKeyFile:
+		line, err = next()
+		if err != nil {
+			return kf, err
+		}
+
+		kf.CardName = SanitizeCardName(line)
+
+		line, err = next()
+		if err != nil {
+			return kf, err
+		}
+
+		if len(line) < cardIDLength || !isCardID(line[:cardIDLength]) {
+			return kf, ErrMalformedKey
+		}
+
+		kf.CardID = strings.ToLower(line[:cardIDLength])
+	}
+
+	var scratch [aesKeyLength]byte
+	defer zero(scratch[:])
+	for kf.Keys < keyFileKeys[kf.Type] {
+		line, err = next()
+		if err != nil {
+			return kf, err
+		}
+
+		key := scratch[:]
+		if kf.Keys < len(keys) {
+			key = keys[kf.Keys]
+		}
+
+		err = unserializeKey(line, key)
+		if err != nil {
+			return kf, err
+		}
+
+		kf.Keys++
+	}
+
+	switch kf.Type {
+	case ManagerKeyFile, LockKeyFile:
+		kf.ECDSAKey = s.Scan() && s.Text() != ""
+		if s.Err() != nil {
+			return kf, s.Err()
+		}
+	}
+
+	return kf, nil
+}
+
+// Parse the slot list of a lock key file like _load_lock_data() does, with
+// strtol() itself, so that the same numbers are found and truncated to int in
+// the same way.
+func parseSlots(line string) ([]int, error) {
+	cline := C.CString(line)
+	defer C.free(unsafe.Pointer(cline))
+
+	var slots []int
+	begin := cline
+	for len(slots) < maxLockSlots {
+		var end *C.char
+		slot := int(C.int(C.strtol(begin, &end, 0)))
+		if end == begin {
+			break
+		}
+
+		if slot != -1 && (slot < SlotMin || slot > SlotMax) {
+			return nil, ErrMalformedKey
+		}
+
+		slots = append(slots, slot)
+		begin = end
+	}
+
+	if len(slots) == 0 {
+		slots = []int{-1}
+	}
+
+	return slots, nil
+}
@@ -0,0 +1,170 @@
+package openkey
+
+import "bufio"
+import "strings"
+import "testing"
+
+// Well-formed key files of each type.
+const (
+	testKey = "000102030405060708090a0b0c0d0e0f\n"
+
+	testProducerKeyFile = producerMagicPrefix + "1\n" + testKey
+
+	testManagerKeyFile = managerMagicPrefix + "1\n" +
+		testKey + "(private-key (ecc))\n"
+
+	testLockKeyFile = lockMagicPrefix + "1\n" +
+		"3 0xe -1\n" + testKey + testKey + "(public-key (ecc))\n"
+
+	testTransportKeyFile = transportMagicPrefix + "1\n" +
+		"card name\n" + "0FF2A8C4-5D1E-4B6A-9C3F-7E2D8A1B6C40\n" +
+		testKey + testKey + testKey
+)
+
+func TestParseKeyFile(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want KeyFile
+	}{
+		{"producer", testProducerKeyFile, KeyFile{Type: ProducerKeyFile, Version: 1, Keys: 1}},
+		{"manager", testManagerKeyFile, KeyFile{Type: ManagerKeyFile, Version: 1, Keys: 1, ECDSAKey: true}},
+		{"lock", testLockKeyFile, KeyFile{Type: LockKeyFile, Version: 1, Keys: 2, ECDSAKey: true, Slots: []int{3, 14, -1}}},
+		{"transport", testTransportKeyFile, KeyFile{Type: TransportKeyFile, Version: 1, Keys: 3,
+			CardName: "card name", CardID: "0ff2a8c4-5d1e-4b6a-9c3f-7e2d8a1b6c40"}},
+		{"old manager", managerMagicPrefix + "1\n" + testKey,
+			KeyFile{Type: ManagerKeyFile, Version: 1, Keys: 1}},
+		{"empty slot line", lockMagicPrefix + "1\n\n" + testKey + testKey,
+			KeyFile{Type: LockKeyFile, Version: 1, Keys: 2, Slots: []int{-1}}},
+	}
+
+	for _, tt := range tests {
+		kf, err := ParseKeyFile(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if kf.Type != tt.want.Type || kf.Version != tt.want.Version || kf.Keys != tt.want.Keys ||
+			kf.ECDSAKey != tt.want.ECDSAKey || kf.CardName != tt.want.CardName ||
+			kf.CardID != tt.want.CardID || !equalInts(kf.Slots, tt.want.Slots) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, kf, tt.want)
+		}
+	}
+}
+
+func TestParseKeyFileMalformed(t *testing.T) {
+	long := strings.Repeat("0", bufio.MaxScanTokenSize+1) + "\n"
+	lock := lockMagicPrefix + "1\n"
+	transport := transportMagicPrefix + "1\ncard name\n"
+
+	tests := []struct {
+		name string
+		in   string
+		err  error
+	}{
+		{"empty", "", ErrMalformedKey},
+		{"no magic", "hello world\n" + testKey, ErrMalformedKey},
+		{"magic only", producerMagicPrefix, ErrMalformedKey},
+		{"truncated key", producerMagicPrefix + "1\n0001020304", ErrMalformedKey},
+		{"missing key", producerMagicPrefix + "1\n", ErrMalformedKey},
+		{"bad key", producerMagicPrefix + "1\n" + strings.Repeat("0", 34) + "\n", ErrMalformedKey},
+		{"missing second key", lock + "-1\n" + testKey, ErrMalformedKey},
+		{"missing third key", transport + "0ff2a8c4-5d1e-4b6a-9c3f-7e2d8a1b6c40\n" + testKey + testKey, ErrMalformedKey},
+		{"version 0", producerMagicPrefix + "0\n" + testKey, ErrMalformedKey},
+		{"negative version", producerMagicPrefix + "-1\n" + testKey, ErrMalformedKey},
+		{"version not a number", producerMagicPrefix + "x\n" + testKey, ErrMalformedKey},
+		{"version 2", producerMagicPrefix + "2\n" + testKey, ErrKeyFileVersion},
+		{"slot too large", lock + "15\n" + testKey + testKey, ErrMalformedKey},
+		{"slot too small", lock + "-2\n" + testKey + testKey, ErrMalformedKey},
+		{"hex slot too large", lock + "0x0f\n" + testKey + testKey, ErrMalformedKey},
+		{"missing slot line", lock, ErrMalformedKey},
+		{"missing card ID", transport, ErrMalformedKey},
+		{"short card ID", transport + "0ff2a8c4-5d1e-4b6a-9c3f\n" + testKey + testKey + testKey, ErrMalformedKey},
+		{"bad card ID", transport + "0ff2a8c4+5d1e-4b6a-9c3f-7e2d8a1b6c40\n" + testKey + testKey + testKey, ErrMalformedKey},
+		{"overlong magic", long, bufio.ErrTooLong},
+		{"overlong key", producerMagicPrefix + "1\n" + long, bufio.ErrTooLong},
+		{"overlong slot line", lock + long + testKey + testKey, bufio.ErrTooLong},
+		{"overlong card name", transportMagicPrefix + "1\n" + long, bufio.ErrTooLong},
+		{"overlong ECDSA key", managerMagicPrefix + "1\n" + testKey + long, bufio.ErrTooLong},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseKeyFile(strings.NewReader(tt.in))
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// The slot lists of lock key files must be read as _load_lock_data() reads
+// them with strtol().
+func TestParseKeyFileSlots(t *testing.T) {
+	tests := []struct {
+		line  string
+		slots []int
+	}{
+		{"", []int{-1}},
+		{"x", []int{-1}},
+		{"3", []int{3}},
+		{"3 x", []int{3}},
+		{"3 x 4", []int{3}},
+		{"3x4", []int{3}},
+		{"  +3\t-1", []int{3, -1}},
+		{"010 0xA", []int{8, 10}},
+		{"08", []int{0, 8}},
+		{"0x", []int{0}},
+		{strings.Repeat("1 ", maxLockSlots+3), []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		in := lockMagicPrefix + "1\n" + tt.line + "\n" + testKey + testKey
+		kf, err := ParseKeyFile(strings.NewReader(in))
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+		} else if !equalInts(kf.Slots, tt.slots) {
+			t.Errorf("%q: got slots %v, want %v", tt.line, kf.Slots, tt.slots)
+		}
+	}
+}
+
+// Feed ParseKeyFile() every prefix of the well-formed key files and variants
+// with single bytes changed, checking that it neither panics nor accepts a
+// file missing a key.
+func TestParseKeyFileMutations(t *testing.T) {
+	files := []string{testProducerKeyFile, testManagerKeyFile, testLockKeyFile, testTransportKeyFile}
+	for _, file := range files {
+		want, err := ParseKeyFile(strings.NewReader(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < len(file); i++ {
+			kf, err := ParseKeyFile(strings.NewReader(file[:i]))
+			if err == nil && kf.Keys != want.Keys {
+				t.Errorf("%q: accepted with %d keys", file[:i], kf.Keys)
+			}
+
+			for _, b := range []byte{0, '\n', ' ', '-', 'x', '9', 0xff} {
+				mutated := []byte(file)
+				mutated[i] = b
+				ParseKeyFile(strings.NewReader(string(mutated)))
+			}
+		}
+	}
+}
+
+// Report whether a and b hold the same ints.
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,370 @@
+package openkey
+
+import "bufio"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+// Names of the files the libopenkey keeps in the base paths of its roles.
+const (
+	producerFileName = "producer"
+	managerFileName  = "manager"
+	lockFileName     = "lock"
+
+	// the producer's log contains no key material
+	producerLogName = "log"
+
+	// the manager's list of issued cards
+	issuedLogName = "issued"
+)
+
+// Prefixes of the first lines of the various key files, each followed by the
+// version of the key storage format.
+const (
+	producerMagicPrefix  = "libopenkey producer secret key storage v"
+	managerMagicPrefix   = "libopenkey manager secret key storage v"
+	lockMagicPrefix      = "libopenkey lock secret key storage v"
+	transportMagicPrefix = "libopenkey transport key file v"
+)
+
+// Length of the AES keys the libopenkey uses.
+const aesKeyLength = 16
+
+// The contents of a lock key file as written by a manager and read by
+// managers and authenticators.
+type lockData struct {
+	// slots to try in order, -1 means "all remaining slots"
+	slots []int
+
+	readKey           [aesKeyLength]byte
+	authenticationKey [aesKeyLength]byte
+}
+
+// The contents of a transport key file as written by a producer for each
+// application it creates and read by a manager owning the card.
+type transportData struct {
+	cardName string
+	cardID   string
+
+	readKey           [aesKeyLength]byte
+	authenticationKey [aesKeyLength]byte
+	updateKey         [aesKeyLength]byte
+}
+
+// Error returned by CheckKeyPermissions() if parts of a key store are
+// accessible by users other than the owner. Paths lists the offending files
+// and directories.
+type PermissionError struct {
+	Paths []string
+}
+
+func (e *PermissionError) Error() string {
+	return "openkey: insecure permissions on " + strings.Join(e.Paths, ", ")
+}
+
+// Get the base path role has been added with. If role has not been added to c,
+// this function returns ErrRoleNotAdded.
+func (c Context) basePath(role Role) (string, error) {
+	if role < 0 || int(role) >= len(c.s.paths) || c.s.paths[role] == "" {
+		return "", ErrRoleNotAdded
+	}
+
+	return c.s.paths[role], nil
+}
+
+// Check that the key store of role is not accessible by anybody but its owner.
+// The base path and everything below it are examined. Directories may be
+// searchable by the group as the libopenkey creates them that way, but must not
+// be readable or writable by the group nor accessible by others. Files must not
+// be accessible by group or others at all. The producer's log is exempt as it
+// holds no key material. Notice that the libopenkey creates the transport key
+// files of a producer readable by the group, so these are reported, too.
+//
+// If offending paths are found, this function returns a *PermissionError
+// listing them. If role has not been added to c, ErrRoleNotAdded is returned.
+// Other errors come from accessing the file system.
+func (c Context) CheckKeyPermissions(role Role) error {
+	base, err := c.basePath(role)
+	if err != nil {
+		return err
+	}
+
+	log := filepath.Join(base, producerLogName)
+	var paths []string
+	err = filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		mask := os.FileMode(0077)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			return nil
+		case info.IsDir():
+			mask = 0067
+		case role == CardProducer && path == log:
+			return nil
+		}
+
+		if info.Mode().Perm()&mask != 0 {
+			paths = append(paths, path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(paths) > 0 {
+		return &PermissionError{paths}
+	}
+
+	return nil
+}
+
+// Decode a key serialized by the libopenkey into key. Like the C code, this
+// function ignores everything but hexadecimal digits and fails unless exactly
+// enough digits to fill key are found.
+func unserializeKey(line string, key []byte) error {
+	n := 0
+	for i := 0; i < len(line); i++ {
+		var nibble byte
+		switch b := line[i]; {
+		case '0' <= b && b <= '9':
+			nibble = b - '0'
+		case 'A' <= b && b <= 'F':
+			nibble = b - 'A' + 0xa
+		case 'a' <= b && b <= 'f':
+			nibble = b - 'a' + 0xa
+		default:
+			continue
+		}
+
+		if n >= 2*len(key) {
+			return ErrMalformedKey
+		}
+
+		key[n/2] = key[n/2]<<4 | nibble
+		n++
+	}
+
+	if n != 2*len(key) {
+		return ErrMalformedKey
+	}
+
+	return nil
+}
+
+// Read the producer's master key stored in directory dir into key. If there is
+// no producer key in dir, ErrNotBootstrapped is returned. Malformed files
+// yield ErrMalformedKey.
+func readProducerKey(dir string, key []byte) error {
+	f, err := os.Open(filepath.Join(dir, producerFileName))
+	if os.IsNotExist(err) {
+		return ErrNotBootstrapped
+	} else if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	kf, err := parseKeyFile(f, [][]byte{key})
+	if err == nil && kf.Type != ProducerKeyFile {
+		err = ErrMalformedKey
+	}
+
+	if err != nil {
+		zero(key)
+		return err
+	}
+
+	return nil
+}
+
+// Version of the producer key storage format this version of the libopenkey
+// reads and writes.
+const ProducerFormatVersion = 1
+
+// Find out the version of the key storage format of the producer whose base
+// path is path. The version is read from the first line of the producer's key
+// file without reading the key. Producer directories of this version of the
+// libopenkey have version ProducerFormatVersion; other versions cannot be used.
+// The libopenkey keeps no other configuration in the producer directory. If
+// there is no producer key in path, ErrNotBootstrapped is returned. If the key
+// file does not start with the line the libopenkey writes, ErrMalformedKey is
+// returned. The role need not have been added to a context.
+func ProducerConfigVersion(path string) (int, error) {
+	f, err := os.Open(filepath.Join(path, producerFileName))
+	if os.IsNotExist(err) {
+		return 0, ErrNotBootstrapped
+	} else if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		if s.Err() != nil {
+			return 0, s.Err()
+		}
+
+		return 0, ErrMalformedKey
+	}
+
+	line := s.Text()
+	if !strings.HasPrefix(line, producerMagicPrefix) {
+		return 0, ErrMalformedKey
+	}
+
+	version, err := strconv.Atoi(line[len(producerMagicPrefix):])
+	if err != nil || version < 1 {
+		return 0, ErrMalformedKey
+	}
+
+	return version, nil
+}
+
+// Read the lock data stored in directory dir. If there is no lock data in dir,
+// this function returns nil, nil. Malformed files yield ErrMalformedKey; see
+// ParseKeyFile() for the details.
+func readLockData(dir string) (*lockData, error) {
+	f, err := os.Open(filepath.Join(dir, lockFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	ld := new(lockData)
+	kf, err := parseKeyFile(f, [][]byte{ld.readKey[:], ld.authenticationKey[:]})
+	if err == nil && kf.Type != LockKeyFile {
+		err = ErrMalformedKey
+	}
+
+	if err != nil {
+		zero(ld.readKey[:])
+		zero(ld.authenticationKey[:])
+		return nil, err
+	}
+
+	ld.slots = kf.Slots
+	return ld, nil
+}
+
+// Read the transport key file file. Malformed files yield ErrMalformedKey; see
+// ParseKeyFile() for the details.
+func readTransportData(file string) (*transportData, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	td := new(transportData)
+	kf, err := parseKeyFile(f, [][]byte{td.readKey[:], td.authenticationKey[:], td.updateKey[:]})
+	if err == nil && kf.Type != TransportKeyFile {
+		err = ErrMalformedKey
+	}
+
+	if err != nil {
+		zero(td.readKey[:])
+		zero(td.authenticationKey[:])
+		zero(td.updateKey[:])
+		return nil, err
+	}
+
+	td.cardName = kf.CardName
+	td.cardID = kf.CardID
+	return td, nil
+}
+
+// Report for each slot whether the lock data of the manager role covers it,
+// i.e. whether the manager's keys are used for cards owned in that slot. The
+// slots are read from the lock data stored under the manager's base path. A
+// manager bootstrapped with a preferred slot of -1 covers all slots. If the
+// manager has not been bootstrapped yet, all slots are reported as false. If
+// the manager role has not been added to c, ErrRoleNotAdded is returned.
+func (c Context) ManagerBootstrapStatus() (map[int]bool, error) {
+	base, err := c.basePath(LockManager)
+	if err != nil {
+		return nil, err
+	}
+
+	ld, err := readLockData(base)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make(map[int]bool, SlotMax-SlotMin+1)
+	for slot := SlotMin; slot <= SlotMax; slot++ {
+		status[slot] = false
+	}
+
+	if ld == nil {
+		return status, nil
+	}
+
+	for _, slot := range ld.slots {
+		if slot != -1 {
+			status[slot] = true
+			continue
+		}
+
+		for slot := range status {
+			status[slot] = true
+		}
+	}
+
+	return status, nil
+}
+
+// List the slots the manager role of c has been bootstrapped for, in the order
+// the manager tries them when owning cards. The slots are recorded in the
+// lock data under the manager's base path when the manager is bootstrapped,
+// so this works across sessions without a card. A manager bootstrapped with a
+// preferred slot of -1 is responsible for all slots; they are listed after
+// the explicitly recorded ones. If the manager has not been bootstrapped,
+// ErrNotBootstrapped is returned. If the manager role has not been added to
+// c, ErrRoleNotAdded is returned. See also ManagerBootstrapStatus().
+func (c Context) BootstrappedSlots() ([]int, error) {
+	base, err := c.basePath(LockManager)
+	if err != nil {
+		return nil, err
+	}
+
+	ld, err := readLockData(base)
+	if err != nil {
+		return nil, err
+	} else if ld == nil {
+		return nil, ErrNotBootstrapped
+	}
+
+	var slots []int
+	listed := make(map[int]bool)
+	for _, slot := range ld.slots {
+		if slot != -1 {
+			if !listed[slot] {
+				listed[slot] = true
+				slots = append(slots, slot)
+			}
+
+			continue
+		}
+
+		for slot := SlotMin; slot <= SlotMax; slot++ {
+			if !listed[slot] {
+				listed[slot] = true
+				slots = append(slots, slot)
+			}
+		}
+	}
+
+	return slots, nil
+}
@@ -98,6 +98,7 @@ struct openkey_context {
 
 		gcry_sexp_t creation_priv_key;
 		uint8_t master_authenticity_update_key[AES_KEY_LENGTH];
+		uint8_t key_version;
 
 		struct lock_data {
 			int slot_list[16 + 1];
@@ -744,6 +745,16 @@ bool openkey_manager_is_bootstrapped(openkey_context_t ctx)
 	return ctx->m.flags.lock_bootstrapped && ctx->m.flags.manager_bootstrapped;
 }
 
+int openkey_manager_set_key_version(openkey_context_t ctx, uint8_t key_version)
+{
+	if(ctx == NULL) {
+		return -1;
+	}
+
+	ctx->m.key_version = key_version;
+	return 0;
+}
+
 int openkey_manager_bootstrap(openkey_context_t ctx, int preferred_slot)
 {
 	if(ctx == NULL || !(ctx->roles_initialized & ROLEMASK(OPENKEY_ROLE_LOCK_MANAGER))) {
@@ -1950,9 +1961,9 @@ static int _do_own_slot(openkey_context_t ctx, MifareTag tag, int slot, struct t
 
 	transport_authentication_key = mifare_desfire_aes_key_new(td->app_transport_authentication_key);
 	transport_update_key = mifare_desfire_aes_key_new(td->app_transport_authenticity_update_key);
-	read_key = mifare_desfire_aes_key_new(ctx->m.l.read_key);
-	authentication_key = mifare_desfire_aes_key_new(derived_authentication_key);
-	update_key = mifare_desfire_aes_key_new(derived_update_key);
+	read_key = mifare_desfire_aes_key_new_with_version(ctx->m.l.read_key, ctx->m.key_version);
+	authentication_key = mifare_desfire_aes_key_new_with_version(derived_authentication_key, ctx->m.key_version);
+	update_key = mifare_desfire_aes_key_new_with_version(derived_update_key, ctx->m.key_version);
 
 	if(transport_authentication_key == NULL || transport_update_key == NULL
 			|| read_key == NULL || authentication_key == NULL || update_key == NULL) {
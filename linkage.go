@@ -0,0 +1,153 @@
+package openkey
+
+// #include <gcrypt.h>
+//
+// static const char *gcrypt_header_version(void) { return GCRYPT_VERSION; }
+import "C"
+import "strconv"
+import "strings"
+
+import "github.com/clausecker/nfc/v2"
+
+// Range of libnfc versions the libfreefare 0.4.0 used by the libopenkey works
+// with: 1.7.0 up to but excluding 2.0.0.
+var (
+	nfcMinVersion = [3]int{1, 7, 0}
+	nfcMaxVersion = [3]int{2, 0, 0}
+)
+
+// A library whose version does not match the versions the libopenkey was
+// built for as reported by CheckLinkage().
+type LibraryMismatch struct {
+	Library  string // name of the library, e.g. "libgcrypt"
+	Version  string // version linked at runtime
+	Required string // description of the versions required
+}
+
+// Returned by CheckLinkage() if the libraries linked at runtime do not match
+// the versions the libopenkey was built for.
+type LinkageError struct {
+	Mismatches []LibraryMismatch
+}
+
+func (e *LinkageError) Error() string {
+	msgs := make([]string, len(e.Mismatches))
+	for i, m := range e.Mismatches {
+		msgs[i] = m.Library + " " + m.Version + " linked, " + m.Required + " required"
+	}
+
+	return "openkey: library version mismatch: " + strings.Join(msgs, "; ")
+}
+
+// Check that the versions of the shared libraries linked at runtime match the
+// versions the libopenkey was built for. The libgcrypt must be at least as new
+// as the headers the package was compiled with and the libnfc must be of
+// version 1.7.0 or newer but older than 2.0.0. The libfreefare and libuuid do
+// not report their versions at runtime and are not checked. If any library is
+// out of range, a *LinkageError listing all mismatches is returned. As a
+// side-effect, this function initializes the libgcrypt; if that fails,
+// ErrGcryptNotInitialized is returned. If the application initializes the
+// libgcrypt, see ExternalGcryptInit(), ErrGcryptNotInitialized is returned
+// until it has done so and the version of the libgcrypt is not checked: the
+// application has to check it with gcry_check_version() when initializing it.
+func CheckLinkage() error {
+	err := initGcrypt()
+	if err != nil {
+		return err
+	}
+
+	var mismatches []LibraryMismatch
+
+	if v, ok := gcryptVersion(); ok {
+		want := C.GoString(C.gcrypt_header_version())
+		if C.gcry_check_version(C.gcrypt_header_version()) == nil {
+			mismatches = append(mismatches, LibraryMismatch{
+				Library:  "libgcrypt",
+				Version:  v,
+				Required: want + " or newer",
+			})
+		}
+	}
+
+	nfcVersion := nfc.Version()
+	v, ok := parseVersion(nfcVersion)
+	if !ok || compareVersions(v, nfcMinVersion) < 0 || compareVersions(v, nfcMaxVersion) >= 0 {
+		mismatches = append(mismatches, LibraryMismatch{
+			Library:  "libnfc",
+			Version:  nfcVersion,
+			Required: "1.7.0 or newer but older than 2.0.0",
+		})
+	}
+
+	if len(mismatches) > 0 {
+		return &LinkageError{mismatches}
+	}
+
+	return nil
+}
+
+// Get the version of the libgcrypt linked at runtime. gcry_check_version() is
+// only called if this package has initialized the libgcrypt as it would
+// otherwise initialize it behind the application's back; if not, false is
+// returned.
+func gcryptVersion() (string, bool) {
+	if initGcrypt() != nil || gcryptState != gcryptReady {
+		return "", false
+	}
+
+	return C.GoString(C.gcry_check_version(nil)), true
+}
+
+// Parse the leading major.minor.patch part of a version string like "1.8.0"
+// or "1.7.1-12-g1234567". A missing patch level is taken to be 0.
+func parseVersion(s string) ([3]int, bool) {
+	var v [3]int
+
+	if i := strings.IndexAny(s, "-+ "); i >= 0 {
+		s = s[:i]
+	}
+
+	fields := strings.Split(s, ".")
+	if len(fields) < 2 || len(fields) > 3 {
+		return v, false
+	}
+
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return v, false
+		}
+
+		v[i] = n
+	}
+
+	return v, true
+}
+
+// Compare two versions, returning -1, 0, or 1 if a is older than, the same
+// as, or newer than b.
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// Report whether the libnfc finds at least one NFC reader. This is a cheap
+// check for the presence of hardware before contexts are set up. Only readers
+// the libnfc can discover by scanning are found; readers configured with
+// manual connection strings only may be missed. Errors come from the libnfc.
+func HasReader() (bool, error) {
+	devs, err := nfc.ListDevices()
+	if err != nil {
+		return false, err
+	}
+
+	return len(devs) > 0, nil
+}
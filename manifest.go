@@ -0,0 +1,144 @@
+package openkey
+
+import "bufio"
+import "bytes"
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+// The key files of each role covered by a key manifest.
+var manifestFiles = [...][]string{
+	CardProducer:      {producerFileName},
+	LockManager:       {managerFileName, lockFileName},
+	CardAuthenticator: {lockFileName},
+}
+
+// Names of the key manifest of each role. Roles may share a base path, so
+// each role has a manifest of its own.
+var manifestNames = [...]string{
+	CardProducer:      "manifest-producer",
+	LockManager:       "manifest-manager",
+	CardAuthenticator: "manifest-authenticator",
+}
+
+// Error returned by VerifyKeyManifest() if a key file does not match the
+// manifest. Path is the key file, Msg describes the mismatch.
+type KeyManifestError struct {
+	Path string
+	Msg  string
+}
+
+func (e *KeyManifestError) Error() string {
+	return "openkey: " + e.Path + ": " + e.Msg
+}
+
+// Record the sizes and SHA-256 hashes of the key files of role in a manifest
+// in its base path, so damage to the key files can later be detected with
+// VerifyKeyManifest(). Write the manifest after bootstrapping the role and
+// whenever its key files have been changed intentionally. Key files that do
+// not exist are not recorded. The manifest is a text file with one line per
+// key file of the form
+//
+//	<SHA-256 in hex> <size in bytes> <file name>
+//
+// and holds no key material. If role has not been added to c,
+// ErrRoleNotAdded is returned.
+func (c Context) WriteKeyManifest(role Role) error {
+	base, err := c.basePath(role)
+	if err != nil {
+		return err
+	}
+
+	var manifest bytes.Buffer
+	for _, name := range manifestFiles[role] {
+		data, err := ioutil.ReadFile(filepath.Join(base, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		zero(data)
+		fmt.Fprintf(&manifest, "%s %d %s\n", hex.EncodeToString(sum[:]), len(data), name)
+	}
+
+	return ioutil.WriteFile(filepath.Join(base, manifestNames[role]), manifest.Bytes(), 0600)
+}
+
+// Check the key files of role against the manifest written by
+// WriteKeyManifest(). If a key file is missing, has the wrong size, or its
+// hash does not match, a *KeyManifestError is returned. If there is no
+// manifest, ErrNoKeyManifest is returned; a malformed manifest yields a
+// *KeyManifestError for the manifest itself. If role has not been added to c,
+// ErrRoleNotAdded is returned. See also SetVerifyKeyManifest().
+func (c Context) VerifyKeyManifest(role Role) error {
+	base, err := c.basePath(role)
+	if err != nil {
+		return err
+	}
+
+	return verifyKeyManifest(role, base)
+}
+
+// Check the key files of role in base path base against its manifest.
+func verifyKeyManifest(role Role, base string) error {
+	manifest := filepath.Join(base, manifestNames[role])
+	f, err := os.Open(manifest)
+	if os.IsNotExist(err) {
+		return ErrNoKeyManifest
+	} else if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.SplitN(s.Text(), " ", 3)
+		if len(fields) != 3 {
+			return &KeyManifestError{manifest, "malformed line " + strconv.Itoa(line)}
+		}
+
+		want, err := hex.DecodeString(fields[0])
+		size, serr := strconv.Atoi(fields[1])
+		if err != nil || serr != nil || len(want) != sha256.Size {
+			return &KeyManifestError{manifest, "malformed line " + strconv.Itoa(line)}
+		}
+
+		path := filepath.Join(base, fields[2])
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return &KeyManifestError{path, "key file missing"}
+		} else if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		zero(data)
+		switch {
+		case len(data) != size:
+			return &KeyManifestError{path, "size " + strconv.Itoa(len(data)) + " does not match manifest size " + fields[1]}
+		case !bytes.Equal(sum[:], want):
+			return &KeyManifestError{path, "contents do not match manifest"}
+		}
+	}
+
+	return s.Err()
+}
+
+// Make AddRole() check the key files of each role added against the manifest
+// of the role before adding it, as VerifyKeyManifest() does. If the check
+// fails, the role is not added and the error is returned; this includes
+// ErrNoKeyManifest if the role has no manifest. Roles already added are not
+// checked.
+func (c Context) SetVerifyKeyManifest(verify bool) {
+	c.s.mu.Lock()
+	c.s.verifyManifest = verify
+	c.s.mu.Unlock()
+}
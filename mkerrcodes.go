@@ -0,0 +1,243 @@
+//go:build ignore
+// +build ignore
+
+// This program generates errcodes.go from libopenkey.c. For each of the C
+// functions listed below, it finds the DO_ABORT(-n) statements, figures out
+// which function call failed to cause them, and emits a named constant for
+// each error code as well as a table mapping codes to the failing call and a
+// description used by Error.Error(). The description names the step of the C
+// function the call belongs to, taken from the numbered comments such as
+// "/* 4th a) create and write each application */" in libopenkey.c. Run it
+// with go generate.
+package main
+
+import "bufio"
+import "bytes"
+import "fmt"
+import "go/format"
+import "io/ioutil"
+import "log"
+import "os"
+import "regexp"
+import "strings"
+
+// The C functions to scan, the prefix for their constants, the Go function
+// the codes are returned from, and the name of the table to generate.
+var functions = []struct {
+	name, prefix, wrapper, table string
+}{
+	{"_openkey_producer_card_create", "Create", "ProducerCardCreate", "createErrors"},
+	{"openkey_manager_card_own_pw", "Own", "ManagerOwnCard", "ownErrors"},
+}
+
+// Names and descriptions for error codes not caused by a failing function
+// call.
+var overrides = map[string]map[int]struct{ name, desc string }{
+	"Create": {
+		6:  {"RandomUID", "random UID is already enabled"},
+		46: {"UIDLength", "UID is too long"},
+	},
+}
+
+var (
+	abortRE  = regexp.MustCompile(`DO_ABORT\(-(\d+)\)`)
+	assignRE = regexp.MustCompile(`([\w>.-]+)\s*=\s*(\w+)\(`)
+	callRE   = regexp.MustCompile(`(\w+)\(`)
+	condRE   = regexp.MustCompile(`if\s*\(\s*([\w>.-]+)`)
+	ifRE     = regexp.MustCompile(`\bif\s*\(`)
+	stepRE   = regexp.MustCompile(`/\*\s*\d+(?:st|nd|rd|th):?\s+(?:[a-z]\)\s+)?(.*?)\s*\*/`)
+)
+
+type code struct {
+	n      int
+	name   string
+	callee string
+	desc   string
+}
+
+func main() {
+	src, err := ioutil.ReadFile("libopenkey.c")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "// Code generated by mkerrcodes.go from libopenkey.c; DO NOT EDIT.")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "package openkey")
+
+	for _, f := range functions {
+		codes := scan(body(src, f.name), f.prefix)
+
+		fmt.Fprintf(&buf, "\n// Error codes returned by %s(). Each constant is named after\n", f.wrapper)
+		fmt.Fprintf(&buf, "// the C function whose failure causes the error in %s().\n", f.name)
+		fmt.Fprintln(&buf, "// If that function is called more than once, the constants for the")
+		fmt.Fprintln(&buf, "// second and later calls carry the number of the call in source order,")
+		fmt.Fprintln(&buf, "// e.g. the suffix 2 for the second call. The message of each Error names")
+		fmt.Fprintln(&buf, "// the step of the C function the call belongs to.")
+		fmt.Fprintln(&buf, "const (")
+		for _, c := range codes {
+			fmt.Fprintf(&buf, "\tErr%s%s Error = %d\n", f.prefix, c.name, c.n)
+		}
+		fmt.Fprintln(&buf, ")")
+
+		fmt.Fprintf(&buf, "\n// The origins of the error codes returned by %s().\n", f.wrapper)
+		fmt.Fprintf(&buf, "var %s = map[Error]errorOrigin{\n", f.table)
+		for _, c := range codes {
+			fmt.Fprintf(&buf, "\tErr%s%s: {%q, %v, %q},\n", f.prefix, c.name, c.callee, isTagOp(c.callee), c.desc)
+		}
+		fmt.Fprintln(&buf, "}")
+	}
+
+	fmt.Fprintln(&buf, "\n// The tables of error origins by the function returning the codes.")
+	fmt.Fprintln(&buf, "var errorTables = []struct {")
+	fmt.Fprintln(&buf, "\tfunction string")
+	fmt.Fprintln(&buf, "\torigins  map[Error]errorOrigin")
+	fmt.Fprintln(&buf, "}{")
+	for _, f := range functions {
+		fmt.Fprintf(&buf, "\t{%q, %s},\n", f.wrapper, f.table)
+	}
+	fmt.Fprintln(&buf, "}")
+
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ioutil.WriteFile("errcodes.go", out, 0666)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Extract the body of the C function name from src.
+func body(src []byte, name string) []string {
+	var lines []string
+	found := false
+	s := bufio.NewScanner(bytes.NewReader(src))
+	for s.Scan() {
+		line := s.Text()
+		if !found {
+			found = strings.HasPrefix(line, "int "+name+"(") ||
+				strings.HasPrefix(line, "static int "+name+"(")
+			continue
+		}
+
+		if line == "}" {
+			return lines
+		}
+
+		lines = append(lines, line)
+	}
+
+	log.Fatalf("function %s not found", name)
+	return nil
+}
+
+// Find the error codes in the lines of a function body.
+func scan(lines []string, prefix string) []code {
+	var codes []code
+	assigned := map[string]string{}
+	seen := map[string]int{}
+	step := ""
+
+	for i, line := range lines {
+		if m := stepRE.FindStringSubmatch(line); m != nil {
+			step = strings.ToLower(m[1][:1]) + m[1][1:]
+		}
+
+		for _, m := range assignRE.FindAllStringSubmatch(line, -1) {
+			assigned[m[1]] = m[2]
+		}
+
+		m := abortRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		var n int
+		fmt.Sscan(m[1], &n)
+
+		// the condition starts on this line or on one of the lines before
+		j := i
+		for j > 0 && !ifRE.MatchString(lines[j]) {
+			j--
+		}
+		cond := strings.Join(lines[j:i+1], " ")
+		cond = cond[:strings.Index(cond, "DO_ABORT")]
+
+		callee := ""
+		for _, m := range callRE.FindAllStringSubmatch(cond, -1) {
+			if m[1] != "if" && m[1] != "sizeof" {
+				callee = m[1]
+				break
+			}
+		}
+
+		if callee == "" {
+			if m := condRE.FindStringSubmatch(cond); m != nil {
+				callee = assigned[m[1]]
+			}
+		}
+
+		name, desc := overrides[prefix][n].name, overrides[prefix][n].desc
+		if name == "" {
+			if callee == "" {
+				log.Fatalf("cannot figure out the origin of %s error %d", prefix, n)
+			}
+
+			name = camel(callee)
+			seen[name]++
+			if seen[name] > 1 {
+				name += fmt.Sprint(seen[name])
+			}
+
+			desc = callee + "() failed"
+		}
+
+		if step != "" {
+			desc = step + ": " + desc
+		}
+
+		codes = append(codes, code{n, name, callee, desc})
+	}
+
+	return codes
+}
+
+// Words that are spelled in all caps in Go identifiers.
+var initialisms = map[string]bool{
+	"aes":  true,
+	"aid":  true,
+	"uid":  true,
+	"uuid": true,
+}
+
+// Turn a C function name into a Go identifier, dropping the common
+// mifare_desfire_ prefix.
+func camel(callee string) string {
+	callee = strings.TrimPrefix(callee, "mifare_desfire_")
+	name := ""
+	for _, part := range strings.Split(callee, "_") {
+		switch {
+		case part == "":
+		case initialisms[part]:
+			name += strings.ToUpper(part)
+		default:
+			name += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+
+	return name
+}
+
+// Does callee talk to the tag? Key and AID constructors do not.
+func isTagOp(callee string) bool {
+	return strings.HasPrefix(callee, "mifare_desfire_") && !strings.HasSuffix(callee, "_new")
+}
+
+func init() {
+	log.SetFlags(0)
+	log.SetPrefix("mkerrcodes: ")
+	log.SetOutput(os.Stderr)
+}
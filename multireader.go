@@ -0,0 +1,116 @@
+package openkey
+
+// #include <stdlib.h>
+// #include "openkey.h"
+import "C"
+import "context"
+import "sync"
+import "time"
+import "unsafe"
+
+import "github.com/clausecker/nfc/v2"
+
+// Authenticates cards on several readers in parallel. As a Context must not be
+// used by multiple goroutines at once, each reader is served by a clone of the
+// context the MultiReader was created with. The clones have the same roles
+// added and share the settings of the original context, e.g. the revocation
+// list, the password function, and the timing function, so changes to the
+// settings of the original context take effect on all readers.
+type MultiReader struct {
+	c    Context
+	devs []nfc.Device
+}
+
+// An event reported by MultiReader.Stream(). Reader is the index of the reader
+// the event comes from in the devices the MultiReader was created with.
+type ReaderEvent struct {
+	AuthEvent
+	Reader int
+}
+
+// Create a MultiReader authenticating cards tapped on devs with the
+// authenticator role of c. c must remain open while the MultiReader is used.
+func NewMultiReader(c Context, devs []nfc.Device) *MultiReader {
+	return &MultiReader{c, append([]nfc.Device{}, devs...)}
+}
+
+// Watch all readers of m for cards and authenticate them as AuthStream() does,
+// one goroutine per reader. The events of all readers are sent on the returned
+// channel which is closed once ctx is done and all readers have stopped. If
+// the context cannot be cloned for each reader, the error is returned and no
+// reader is watched. Hooks set on the original context may be called from
+// multiple goroutines at once.
+func (m *MultiReader) Stream(ctx context.Context, debounce time.Duration) (<-chan ReaderEvent, error) {
+	clones := make([]Context, 0, len(m.devs))
+	for range m.devs {
+		clone, err := m.c.clone()
+		if err != nil {
+			for _, clone := range clones {
+				clone.Close()
+			}
+
+			return nil, err
+		}
+
+		clones = append(clones, clone)
+	}
+
+	events := make(chan ReaderEvent)
+	var wg sync.WaitGroup
+	for i, dev := range m.devs {
+		wg.Add(1)
+		go func(reader int, c Context, dev nfc.Device) {
+			defer wg.Done()
+			defer c.Close()
+
+			for ev := range c.AuthStream(ctx, dev, debounce) {
+				select {
+				case events <- ReaderEvent{ev, reader}:
+				case <-ctx.Done():
+				}
+			}
+		}(i, clones[i], dev)
+	}
+
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	return events, nil
+}
+
+// Create a new context with the same roles added as c and sharing the
+// settings of c. Closing the clone does not affect c.
+func (c Context) clone() (Context, error) {
+	err := initGcrypt()
+	if err != nil {
+		return Context{}, err
+	}
+
+	ctxtptr := C.openkey_init()
+	if ctxtptr == nil {
+		return Context{}, ErrInitFailed
+	}
+
+	c.s.mu.Lock()
+	c.s.refs++
+	c.s.mu.Unlock()
+
+	clone := Context{&ctxtptr, c.s, &operations{}}
+	for role, path := range c.s.paths {
+		if path == "" {
+			continue
+		}
+
+		cpath := C.CString(path)
+		r := C.openkey_role_add(ctxtptr, C.enum_openkey_role(role), cpath)
+		C.free(unsafe.Pointer(cpath))
+		if r != 0 {
+			clone.Close()
+			return Context{}, Error(-r)
+		}
+	}
+
+	return clone, nil
+}
@@ -1,75 +1,440 @@
 // Go bindings for the libopenkey. These bindings use the libfreefare bindings
 // from package github.com/clausecker/freefare. Please notice that these
 // bindings ship their own copy of the libopenkey.
+//
+// The libopenkey talks to cards through the tags passed to it and never
+// configures the NFC reader itself. Reader options such as RF timeouts are thus
+// set on the libnfc device the tag was obtained from and are honored by all
+// subsequent openkey operations on tags of that device. For example, to give
+// slow cards more time to answer during authentication, do
+//
+//	err := tag.Device().SetPropertyInt(nfc.TimeoutCom, 200)
+//
+// before calling Context.AuthenticateCard(). See package
+// github.com/clausecker/nfc/v2 for the available properties.
+//
+// The card operations of this package connect to the tag passed to them,
+// i.e. select it, and disconnect from it before they return, whether they
+// succeed or not. A tag must thus be inactive when passed to a card operation,
+// i.e. it must not be connected with tag.Connect(). The same tag can be used
+// for multiple card operations during one tap, but deselecting the tag at the
+// end of an operation may fail, leaving the tag active, and the card may have
+// left the field in between. Call EnsureConnected() between two operations on
+// the same tag to recover from this. Cards produced by the libopenkey report
+// a random UID that changes whenever the card leaves the field, so a tag
+// cannot be reused once the card has been removed; detect it again instead.
+//
+// Card operations return an Error if the libopenkey failed for a reason of its
+// own. If the failure was caused by the tag and errno was set, the wrapper
+// instead returns the result of freefare.Tag.TranslateError(), most often a
+// freefare.Error. ProducerCardCreate(), ManagerOwnCard(), and
+// AuthenticateCard() wrap that error in a *StepError whose Step names the
+// DESFire command that failed, e.g. "authenticate" or "select application",
+// telling communication problems apart from key problems. The libopenkey does
+// not report which command failed while authenticating a card, so for
+// AuthenticateCard() Step is "connect" or "authenticate card". Use
+// FreefareCode() to get the numeric libfreefare error code out of an error.
 package openkey
 
 // #cgo LDFLAGS: -lnfc -lfreefare -luuid -lgcrypt
 // #cgo CFLAGS: -std=gnu99
+// #include <limits.h>
 // #include <stdlib.h>
 // #include <gcrypt.h>
 // #include "openkey.h"
+//
+// // cgo cannot call the variadic gcry_control() directly
+// static int fips_mode_active(void) { return gcry_fips_mode_active(); }
+// static void finish_initialization(void) { gcry_control(GCRYCTL_INITIALIZATION_FINISHED, 0); }
+// static void disable_secmem(void) { gcry_control(GCRYCTL_DISABLE_SECMEM, 0); }
+// static int initialization_finished(void) { return gcry_control(GCRYCTL_INITIALIZATION_FINISHED_P); }
 import "C"
-import "sort"
+import "context"
+import "crypto/subtle"
+import "encoding/hex"
+import "errors"
+import "log/syslog"
+import "os"
 import "strconv"
+import "strings"
 import "sync"
+import "syscall"
+import "time"
 import "unsafe"
 
 import "github.com/clausecker/freefare"
 
+// The role of an openkey context. A context can have multiple roles.
+type Role int
+
 // Roles
 const (
-	CardProducer = iota
+	CardProducer Role = iota
 	LockManager
 	CardAuthenticator
 )
 
+// Range of slots an openkey card can be owned in.
+const (
+	SlotMin = C.OPENKEY_SLOT_MIN
+	SlotMax = C.OPENKEY_SLOT_MAX
+)
+
+// The DESFire application ID of slot 0. The application of slot n has the
+// application ID BaseAID + n.
+const BaseAID = C.OPENKEY_BASE_AID
+
 // An error code caused by the libopenkey. This is usually the negated return
 // value.
 type Error int
 
-// Returns a human-readable string describing the error. The strings returned
-// by this function are not guaranteed to remain stable.
+// Returns a human-readable string describing the error. For the codes of the
+// card operations listed in errcodes.go, the string describes the failure
+// the code stands for. An Error does not record which libopenkey function
+// returned it, so if the code means different things for different card
+// operations, all of them are described. The strings returned by this
+// function are not guaranteed to remain stable.
 func (e Error) Error() string {
-	return "openkey error #" + strconv.Itoa(int(e))
+	msg := "openkey error #" + strconv.Itoa(int(e))
+
+	var causes []string
+	for _, t := range errorTables {
+		if origin, ok := t.origins[e]; ok {
+			causes = append(causes, t.function+": "+origin.desc)
+		}
+	}
+
+	if len(causes) > 0 {
+		msg += " (" + strings.Join(causes, "; ") + ")"
+	}
+
+	return msg
 }
 
+// Find the libfreefare error code in err. The card operations of this package
+// report errors caused by the tag as the result of
+// freefare.Tag.TranslateError(), mostly wrapped in a *StepError: a
+// freefare.Error carrying the numeric libfreefare error code, an error from
+// the NFC device, or an unexpected syscall.Errno. This function unwraps err with the Unwrap() method of each
+// error until it finds a freefare.Error, whose numeric value is the code the C
+// tools log. If one is found, it is returned along with true; otherwise
+// FreefareCode() returns 0, false.
+func FreefareCode(err error) (freefare.Error, bool) {
+	for err != nil {
+		if code, ok := err.(freefare.Error); ok {
+			return code, true
+		}
+
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+
+		err = u.Unwrap()
+	}
+
+	return 0, false
+}
+
+// Make card operations on c return the Error from the libopenkey unchanged.
+// By default, errors caused by the tag are translated as described for
+// FreefareCode() and failed authentications are examined to return errors such
+// as ErrWrongPassword. This can hide the original error code, so disabling
+// translation may help with debugging the libopenkey.
+func (c Context) SetRawErrors(raw bool) {
+	c.s.mu.Lock()
+	c.s.raw = raw
+	c.s.mu.Unlock()
+}
+
+// Is error translation disabled for c?
+func (c Context) rawErrors() bool {
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+	return c.s.raw
+}
+
+// The origin of an Error returned by a libopenkey function: the name of the C
+// function whose failure caused it, whether that function operates on the
+// tag, in which case errno can be translated with freefare.Tag.TranslateError(),
+// and a description of the failure for Error.Error(). The tables of origins
+// are generated from libopenkey.c by mkerrcodes.go.
+type errorOrigin struct {
+	function string
+	tag      bool
+	desc     string
+}
+
+// Wrap err, the translated error from a failed call to the libfreefare
+// function named function, into a *StepError naming the DESFire command,
+// e.g. "change key" for mifare_desfire_change_key().
+func commandError(function string, err error) error {
+	cmd := strings.TrimPrefix(function, "mifare_desfire_")
+	return &StepError{strings.Replace(cmd, "_", " ", -1), err}
+}
+
+//go:generate go run mkerrcodes.go
+
+// Errors generated by this wrapper instead of the libopenkey.
+var (
+	ErrRoleNotAdded = errors.New("openkey: role has not been added")
+	ErrNoTags       = errors.New("openkey: no tags given")
+	ErrMalformedKey = errors.New("openkey: malformed key file")
+	ErrMalformedLog = errors.New("openkey: malformed producer log")
+	ErrInvalidSlot  = errors.New("openkey: invalid slot")
+
+	ErrNotBootstrapped = errors.New("openkey: role has not been bootstrapped")
+
+	ErrInvalidCardName      = errors.New("openkey: invalid card name")
+	ErrMalformedCardID      = errors.New("openkey: malformed card ID")
+	ErrNotOpenkeyCard       = errors.New("openkey: not an openkey card")
+	ErrWrongPassword        = errors.New("openkey: wrong password")
+	ErrCardIDMismatch       = errors.New("openkey: card ID mismatch")
+	ErrCardRevoked          = errors.New("openkey: card has been revoked")
+	ErrNoRevocationList     = errors.New("openkey: no revocation list loaded")
+	ErrCardNotAllowed       = errors.New("openkey: card is not on the allow list")
+	ErrPoolClosed           = errors.New("openkey: pool has been closed")
+	ErrNoFIPSMode           = errors.New("openkey: libgcrypt is not in FIPS mode")
+	ErrRateLimited          = errors.New("openkey: too many authentication attempts")
+	ErrSecMemExhausted      = errors.New("openkey: libgcrypt secure memory exhausted")
+	ErrInvalidPassword      = errors.New("openkey: invalid password")
+	ErrTimeout              = errors.New("openkey: operation timed out")
+	ErrPathTooLong          = errors.New("openkey: path too long")
+	ErrDuplicateAID         = errors.New("openkey: duplicate application ID")
+	ErrMalformedBundle      = errors.New("openkey: malformed key bundle")
+	ErrWrongPassphrase      = errors.New("openkey: wrong passphrase or corrupted key bundle")
+	ErrInitFailed           = errors.New("openkey: cannot create context")
+	ErrGcryptNotInitialized = errors.New("openkey: libgcrypt could not be initialized")
+	ErrPasswordTooShort     = errors.New("openkey: password too short")
+	ErrPasswordTooLong      = errors.New("openkey: password too long")
+	ErrPasswordBadByte      = errors.New("openkey: password contains a byte not allowed")
+	ErrNoKeyManifest        = errors.New("openkey: no key manifest")
+	ErrKeyFileVersion       = errors.New("openkey: unsupported key file version")
+	ErrGcryptInitialized    = errors.New("openkey: libgcrypt has already been initialized")
+	ErrInvalidArgument      = errors.New("openkey: invalid argument")
+	ErrCardNameTooLong      = errors.New("openkey: card name longer than " +
+		strconv.Itoa(maxCardNameLength) + " bytes")
+	ErrOperationsInFlight = errors.New("openkey: card operations in flight")
+	ErrSlotOccupied       = errors.New("openkey: slot is already occupied")
+)
+
 // An openkey context. This type wraps openkey_context_t. Allocate an object of
 // this type using the New() function.
 type Context struct {
 	cptr *C.openkey_context_t
+	s    *state
+	ops  *operations
+}
+
+// State kept by the wrapper alongside the C context.
+type state struct {
+	// base paths of the roles added to the context
+	paths [3]string
+
+	// card IDs rejected by AuthenticateCard(), possibly shared with other
+	// contexts, and card IDs admitted by it if not nil, guarded by mu
+	mu         sync.RWMutex
+	revocation *RevocationList
+	allowed    map[string]bool
+
+	// called with the duration of each card operation, guarded by mu
+	timing func(op string, d time.Duration)
+
+	// asked for passwords by AuthenticateCard(), guarded by mu
+	password PasswordFunc
+
+	// default time limit for card operations, guarded by mu
+	timeout time.Duration
+
+	// whether to skip error translation, guarded by mu
+	raw bool
+
+	// directory of the production log or "" if none, guarded by mu
+	productionLog string
+
+	// password policy or nil if none, guarded by mu
+	policy *PasswordPolicy
+
+	// dedicated thread for card operations or nil if none, guarded by mu
+	thread *osThread
+
+	// whether AddRole() checks key manifests, guarded by mu
+	verifyManifest bool
+
+	// creates spans for card operations or nil if none, guarded by mu
+	tracer Tracer
+
+	// system log receiving audit messages or nil if none, guarded by mu
+	audit *syslog.Writer
+
+	// what Close() does with operations in flight, guarded by mu
+	closeMode CloseMode
+
+	// number of open contexts sharing the state, guarded by mu
+	refs int
+}
+
+// Drop the reference to s held by a context that has been closed. Once the
+// last context sharing s has been closed, the resources held by its settings
+// are released.
+func (s *state) release() {
+	s.mu.Lock()
+	s.refs--
+	if s.refs > 0 {
+		s.mu.Unlock()
+		return
+	}
+
+	audit, thread := s.audit, s.thread
+	s.audit, s.thread = nil, nil
+	s.mu.Unlock()
+
+	if audit != nil {
+		audit.Close()
+	}
+
+	if thread != nil {
+		close(thread.quit)
+	}
 }
 
 // Create a new openkey context. This function wraps openkey_context_init(). If
 // initialization of the context fails, this function panics. A context
-// allocated with New() must be released after use with Close().
+// allocated with New() must be released after use with Close(). See
+// NewContext() for a variant returning an error instead.
 func New() Context {
+	c, err := NewContext()
+	switch err {
+	case nil:
+		return c
+	case ErrGcryptNotInitialized:
+		panic("Could not initialize libgcrypt")
+	default:
+		panic("Could not create openkey.Context: C.openkey_init() failed")
+	}
+}
+
+// Create a new openkey context like New() but return an error instead of
+// panicking if that fails: ErrGcryptNotInitialized if the libgcrypt cannot be
+// initialized and ErrInitFailed if the libopenkey cannot create the context.
+// A context allocated with NewContext() must be released after use with
+// Close().
+func NewContext() (Context, error) {
+	err := initGcrypt()
+	if err != nil {
+		return Context{}, err
+	}
+
 	ctxtptr := C.openkey_init()
 	if ctxtptr == nil {
-		panic("Could not create openkey.Context: C.openkey_init() failed")
+		return Context{}, ErrInitFailed
 	}
 
-	return Context{&ctxtptr}
+	return Context{&ctxtptr, &state{refs: 1}, &operations{}}, nil
+}
+
+// Create a new openkey context and add role to it with base path
+// privateBasePath. If the context cannot be created, the error from
+// NewContext() is returned. If adding the role fails, the context is closed
+// and the error from AddRole() is returned.
+func NewWithRole(role Role, privateBasePath string) (Context, error) {
+	c, err := NewContext()
+	if err != nil {
+		return Context{}, err
+	}
+
+	err = c.AddRole(role, privateBasePath)
+	if err != nil {
+		c.Close()
+		return Context{}, err
+	}
+
+	return c, nil
+}
+
+// Like NewWithRole() but panic if creating the context or adding the role
+// fails. This is intended for programs with a fixed configuration that cannot
+// continue without a context.
+func MustContext(role Role, privateBasePath string) Context {
+	c, err := NewWithRole(role, privateBasePath)
+	if err != nil {
+		panic("openkey: cannot create context with role: " + err.Error())
+	}
+
+	return c
 }
 
 // Release an openkey context. This function wraps openkey_context_fini(). This
-// function fails with an error iff the context has already been closed. It is
-// save to ignore any errors coming from this function.
+// function fails with an Error iff the context has already been closed. It is
+// save to ignore such errors coming from this function.
+//
+// If card operations on c are still in flight, Close() waits for them to
+// finish or fails with ErrOperationsInFlight, leaving c open, as chosen with
+// SetCloseMode(). Ignoring ErrOperationsInFlight leaks the context. Closing c
+// from a hook called during a card operation, e.g. the password function,
+// deadlocks with CloseWait.
+//
+// Contexts cloned from c for a MultiReader share its settings. Once the last
+// of them has been closed, the connection to the system log opened by
+// SetAuditSyslog() is closed and the thread started by SetDedicatedThread()
+// is stopped.
 //
 // Usage of a context after Close() results in an error.
 func (c Context) Close() error {
+	c.s.mu.RLock()
+	mode := c.s.closeMode
+	c.s.mu.RUnlock()
+
+	err := c.ops.lockIdle(mode == CloseWait)
+	if err != nil {
+		return err
+	}
+
+	defer c.ops.mu.Unlock()
+
 	r := C.openkey_fini(*c.cptr)
 	if r != 0 {
 		return Error(-r)
 	}
 
 	*c.cptr = nil
+	c.s.release()
 	return nil
 }
 
+// Report whether c and other refer to the same openkey context, i.e. whether
+// one is a copy of the other. Contexts created separately are never equal,
+// even if they have the same roles added. A context remains equal to its
+// copies after it has been closed. The zero Context is only equal to itself.
+func (c Context) Equal(other Context) bool {
+	return c.cptr == other.cptr
+}
+
 // Add a role to an openkey context. For a description of the possible errors,
 // have a look at libopenkey.c. There is no documentation but you can possibly
 // figure out where your error came from if you look long enough.
-func (c Context) AddRole(role int, privateBasePath string) error {
+//
+// If privateBasePath is too long for the paths the libopenkey builds from it
+// to fit into PATH_MAX bytes, a *PathTooLongError is returned. If key
+// manifests are verified (see SetVerifyKeyManifest()), errors from the
+// verification are returned and the role is not added.
+func (c Context) AddRole(role Role, privateBasePath string) error {
+	err := checkPathLength(role, privateBasePath)
+	if err != nil {
+		return err
+	}
+
+	c.s.mu.RLock()
+	verify := c.s.verifyManifest
+	c.s.mu.RUnlock()
+
+	if verify && role >= 0 && int(role) < len(manifestNames) {
+		err = verifyKeyManifest(role, privateBasePath)
+		if err != nil {
+			return err
+		}
+	}
+
 	cpbp := C.CString(privateBasePath)
 	defer C.free(unsafe.Pointer(cpbp))
 
@@ -78,9 +443,102 @@ func (c Context) AddRole(role int, privateBasePath string) error {
 		return Error(-r)
 	}
 
+	c.s.paths[role] = privateBasePath
 	return nil
 }
 
+// Maximum length of a path including the terminating NUL byte.
+const pathMax = C.PATH_MAX
+
+// Maximum length of a card name. The libopenkey stores the transport key files
+// of a card in a directory named "<UID in hex>-<card name>", which must fit
+// into NAME_MAX bytes. The UID has 7 bytes.
+const maxCardNameLength = C.NAME_MAX - len("00112233445566-")
+
+// Report the maximum length of a card name in bytes. ProducerCardCreate() and
+// its variants return ErrCardNameTooLong for longer card names, as does
+// ProducerCardRecreate() for longer card names or old IDs. The libopenkey
+// replaces unusual characters in card names but keeps their length.
+func MaxCardNameLength() int {
+	return maxCardNameLength
+}
+
+// Length of the longest suffix the libopenkey appends to the base path of a
+// role with a fixed length: the producer's key file, the manager's copies of
+// transport key files (named after card IDs), and the lock key file.
+var pathSuffixLength = [...]int{
+	CardProducer:      len("/" + producerFileName),
+	LockManager:       len("/cards/") + cardIDLength,
+	CardAuthenticator: len("/" + lockFileName),
+}
+
+// Error returned if a path is too long for the libopenkey. Length is the
+// length of Path, Max the maximum permitted length. This error matches
+// ErrPathTooLong with errors.Is().
+type PathTooLongError struct {
+	Path        string
+	Length, Max int
+}
+
+func (e *PathTooLongError) Error() string {
+	return "openkey: path too long (" + strconv.Itoa(e.Length) + " > " +
+		strconv.Itoa(e.Max) + " bytes): " + e.Path
+}
+
+// Report whether target is ErrPathTooLong.
+func (e *PathTooLongError) Is(target error) bool {
+	return target == ErrPathTooLong
+}
+
+// Check that the paths the libopenkey builds from the base path of role fit
+// into PATH_MAX bytes.
+func checkPathLength(role Role, path string) error {
+	max := pathMax - 1
+	if role >= 0 && int(role) < len(pathSuffixLength) {
+		max -= pathSuffixLength[role]
+	}
+
+	if len(path) > max {
+		return &PathTooLongError{path, len(path), max}
+	}
+
+	return nil
+}
+
+// Check that the paths of the transport key files the producer of c writes
+// for a card named cardName fit into PATH_MAX bytes. The longest of them is
+// "<base path>/<UID in hex>-<card name>/<card name>-<slot>"; the path in the
+// *PathTooLongError returned otherwise has a placeholder for the UID. If c has
+// no producer role, the libopenkey reports the error instead.
+func (c Context) checkCardPathLength(cardName string) error {
+	base, err := c.basePath(CardProducer)
+	if err != nil {
+		return nil
+	}
+
+	path := base + "/00112233445566-" + cardName + "/" + cardName + "-" + strconv.Itoa(SlotMax)
+	if len(path) > pathMax-1 {
+		return &PathTooLongError{path, len(path), pathMax - 1}
+	}
+
+	return nil
+}
+
+// Add a role to an openkey context, creating privateBasePath first if it does
+// not exist yet. Missing directories are created with mode 0700 as the base
+// path holds private key material. The libopenkey itself only creates the last
+// component of privateBasePath and makes it group-searchable. Errors from
+// creating the directory are returned as is, otherwise this function behaves
+// like AddRole().
+func (c Context) AddRoleCreate(role Role, privateBasePath string) error {
+	err := os.MkdirAll(privateBasePath, 0700)
+	if err != nil {
+		return err
+	}
+
+	return c.AddRole(role, privateBasePath)
+}
+
 // Has a producer role been bootstrapped? This function also returns false if
 // c has already been closed.
 func (c Context) IsProducerBootstrapped() bool {
@@ -102,33 +560,48 @@ func (c Context) BootstrapProducer() (bool, error) {
 }
 
 // Create an openkey card. This function may either return an Error object or
-// any of the error objects freefare.Tag.TranslateError() may return; the
-// wrapper automatically translates error codes to a freefare.Error if it finds
-// that the error was produced by the libfreefare.
+// a *StepError wrapping any of the error objects freefare.Tag.TranslateError()
+// may return; the wrapper automatically translates error codes to a
+// freefare.Error if it finds that the error was produced by the libfreefare.
+// The Error values returned are listed as the ErrCreate constants. If the paths of the transport key
+// files for cardName do not fit into PATH_MAX bytes, a *PathTooLongError is
+// returned before the card is touched.
 func (c Context) ProducerCardCreate(tag freefare.DESFireTag, cardName string) error {
+	return c.run(context.Background(), func() error {
+		return c.producerCardCreate(tag, cardName)
+	})
+}
+
+// Implementation of ProducerCardCreate().
+func (c Context) producerCardCreate(tag freefare.DESFireTag, cardName string) (err error) {
+	span := c.startSpan("ProducerCardCreate", CardProducer, -1)
+	defer func() { span.End(err) }()
+
+	if len(cardName) > maxCardNameLength {
+		return ErrCardNameTooLong
+	}
+
+	err = c.checkCardPathLength(cardName)
+	if err != nil {
+		return err
+	}
+
 	ccn := C.CString(cardName)
 	defer C.free(unsafe.Pointer(ccn))
 
+	start := time.Now()
 	r, err := C.openkey_producer_card_create(*c.cptr, tagptr(tag), ccn)
+	c.reportTiming("ProducerCardCreate", time.Since(start))
 	if r >= 0 {
-		return nil
+		return c.recordProduced(cardName)
 	}
 
-	// figure out if error comes from the MifareTag. The following return
-	// codes have been found to come from operatons on tag. If err == nil,
-	// i.e. errno not set, we return the openkey error code instead as it
-	// gives us more than just an "unknown error".
-	if err == nil {
-		return Error(-r)
-	}
-
-	tagErrors := []int{
-		4, 5, 12, 13, 15, 16, 17, 18, 19, 20, 21,
-		23, 24, 25, 26, 27, 28, 29, 30, 31, 31, 34}
-
-	index := sort.SearchInts(tagErrors, int(-r))
-	if index < len(tagErrors) && tagErrors[index] == int(-r) {
-		return tag.TranslateError(err)
+	// figure out if error comes from the MifareTag. createErrors records
+	// which return codes come from operations on tag. If err == nil, i.e.
+	// errno not set, we return the openkey error code instead as it gives
+	// us more than just an "unknown error".
+	if origin := createErrors[Error(-r)]; err != nil && !c.rawErrors() && origin.tag {
+		return commandError(origin.function, tag.TranslateError(err))
 	}
 
 	return Error(-r)
@@ -142,7 +615,30 @@ func (c Context) ProducerCardCreate(tag freefare.DESFireTag, cardName string) er
 // inexact. Specifically, the translation routine looks for errno and translates
 // the error code if errno is set. Since versions of the libfreefare up to 0.4.0
 // do not set errno on authentication failure, error reporting might be wrong.
+// To verify that the card has been rewritten, check the last entry of
+// ProducerLog(). As with ProducerCardCreate(), a *PathTooLongError is returned
+// if cardName makes the paths of the transport key files too long.
 func (c Context) ProducerCardRecreate(tag freefare.DESFireTag, cardName, oldId string) error {
+	return c.run(context.Background(), func() error {
+		return c.producerCardRecreate(tag, cardName, oldId)
+	})
+}
+
+// Implementation of ProducerCardRecreate().
+func (c Context) producerCardRecreate(tag freefare.DESFireTag, cardName, oldId string) (err error) {
+	span := c.startSpan("ProducerCardRecreate", CardProducer, -1)
+	defer func() { span.End(err) }()
+
+	// oldId is either a UID or a card name
+	if len(cardName) > maxCardNameLength || len(oldId) > maxCardNameLength {
+		return ErrCardNameTooLong
+	}
+
+	err = c.checkCardPathLength(cardName)
+	if err != nil {
+		return err
+	}
+
 	ccn := C.CString(cardName)
 	defer C.free(unsafe.Pointer(ccn))
 
@@ -154,7 +650,7 @@ func (c Context) ProducerCardRecreate(tag freefare.DESFireTag, cardName, oldId s
 		return nil
 	}
 
-	if err == nil {
+	if err == nil || c.rawErrors() {
 		return Error(-r)
 	}
 
@@ -181,13 +677,73 @@ func (c Context) BootstrapManager(preferredSlot int) (bool, error) {
 	}
 }
 
+// Set the key version of the keys ManagerOwnCard() writes into the
+// applications it owns, i.e. the read, authentication, and update keys. The
+// key version is a byte stored alongside each DESFire key that plays no role
+// in authentication; other applications may use it to tell keys apart. By
+// default, the key version is 0, as are the versions of all keys the producer
+// writes. ManagerChangeCardPassword() keeps the version of the key it
+// changes. Use CardKeyVersion() to read a key version from a card. This
+// function fails with Error(1) if c has already been closed.
+func (c Context) SetKeyVersion(version byte) error {
+	r := C.openkey_manager_set_key_version(*c.cptr, C.uint8_t(version))
+	if r < 0 {
+		return Error(-r)
+	}
+
+	return nil
+}
+
+// Check that c can be used to both produce and own cards. The libopenkey
+// derives the keys of producer and manager independently from each other; a
+// manager can own any card produced by any producer given the transport key
+// files written during production. The only requirement thus is that both
+// roles have been added to c and bootstrapped. This function returns
+// ErrRoleNotAdded or ErrNotBootstrapped if that is not the case.
+func (c Context) ValidateProducerManagerCompatibility() error {
+	for _, role := range []Role{CardProducer, LockManager} {
+		_, err := c.basePath(role)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !c.IsProducerBootstrapped() || !c.IsManagerBootstrapped() {
+		return ErrNotBootstrapped
+	}
+
+	return nil
+}
+
 // Own a card. This function wraps openkey_manager_card_own_pw(). To own a card
 // without a password (as with openkey_manager_card_own()), pass nil for pw.
-// This function may either return an Error object or any of the error objects
-// freefare.Tag.TranslateError() may return; the wrapper automatically
-// translates error codes to a freefare.Error if it finds that the error was
-// produced by the libfreefare.
+// keyFile is the transport key file the producer wrote for the card, see
+// TransportKeyFilePath().
+// This function may either return an Error object or a *StepError wrapping any
+// of the error objects freefare.Tag.TranslateError() may return; the wrapper
+// automatically translates error codes to a freefare.Error if it finds that the
+// error was produced by the libfreefare. The Error values returned are listed
+// as the ErrOwn constants.
+//
+// Each card owned is recorded in the list of issued cards, see IssuedCards().
+// If recording fails, a *LedgerError is returned: the card has been owned
+// nevertheless.
 func (c Context) ManagerOwnCard(tag freefare.DESFireTag, slot int, keyFile string, pw []byte) error {
+	return c.run(context.Background(), func() error {
+		return c.managerOwnCard(tag, slot, keyFile, pw)
+	})
+}
+
+// Implementation of ManagerOwnCard().
+func (c Context) managerOwnCard(tag freefare.DESFireTag, slot int, keyFile string, pw []byte) (err error) {
+	span := c.startSpan("ManagerOwnCard", LockManager, slot)
+	defer func() { span.End(err) }()
+
+	err = c.checkPasswordPolicy(pw)
+	if err != nil {
+		return err
+	}
+
 	ckf := C.CString(keyFile)
 	defer C.free(unsafe.Pointer(ckf))
 
@@ -196,11 +752,26 @@ func (c Context) ManagerOwnCard(tag freefare.DESFireTag, slot int, keyFile strin
 		pwptr = (*C.uint8_t)(&pw[0])
 	}
 
+	start := time.Now()
 	r, err := C.openkey_manager_card_own_pw(
 		*c.cptr, tagptr(tag), C.int(slot), ckf, pwptr, C.size_t(len(pw)))
+	c.reportTiming("ManagerOwnCard", time.Since(start))
 
-	if err != nil && (r == -1 || r == -4) {
-		return tag.TranslateError(err)
+	if r >= 0 {
+		err = c.recordIssued(tag, slot, keyFile)
+		if err != nil {
+			err = &LedgerError{err}
+		}
+
+		return err
+	}
+
+	if err != nil && !c.rawErrors() {
+		if origin := ownErrors[Error(-r)]; origin.tag {
+			return commandError(origin.function, tag.TranslateError(err))
+		} else if r == -1 {
+			return tag.TranslateError(err)
+		}
 	}
 
 	return Error(-r)
@@ -217,40 +788,204 @@ func (c Context) PrepareAuthenticator() bool {
 // has been added to the context. This function wraps
 // openkey_authenticator_authenticate_pw(). To get the functionality of
 // openkey_authenticator_authenticate(), pass nil for pw. This function may
-// either return an Error object or any of the error objects
-// freefare.Tag.TranslateError() may return; the wrapper automatically
+// either return an Error object or a *StepError wrapping any of the error
+// objects freefare.Tag.TranslateError() may return; the wrapper automatically
 // translates error codes to a freefare.Error if it finds that the error was
-// produced by the libfreefare.
+// produced by the libfreefare. As the libopenkey does not report which
+// command failed, Step is "authenticate card" for all failures after
+// connecting to the card.
+//
+// If the card could not be authenticated, the wrapper examines it to find out
+// why. ErrNotOpenkeyCard is returned if the card carries no openkey
+// applications. ErrWrongPassword is returned if the card has been owned for
+// the authenticator's lock but does not accept pw; this includes the case
+// where the card has a password and pw is empty. In that case, the password
+// function set with SetPasswordFunc() is asked for a password, if any, and the
+// card is authenticated once more with the password it returns.
+//
+// If the card authenticates but its ID is on the revocation list set with
+// SetRevocationList(), ErrCardRevoked is returned along with the card ID. If an
+// allow list has been set with SetAllowList() and the card ID is not on it,
+// ErrCardNotAllowed is returned along with the card ID.
 func (c Context) AuthenticateCard(tag freefare.DESFireTag, pw []byte) (cardId string, err error) {
+	return c.authenticateCardContext(context.Background(), tag, pw)
+}
+
+// Implementation of AuthenticateCard().
+func (c Context) authenticateCard(tag freefare.DESFireTag, pw []byte) (cardId string, err error) {
+	span := c.startSpan("AuthenticateCard", CardAuthenticator, -1)
+	defer func() { span.End(err) }()
+
+	err = c.checkPasswordPolicy(pw)
+	if err != nil {
+		return "", err
+	}
+
 	var cid *C.char
 	var pwptr *C.uint8_t
 	if len(pw) > 0 {
 		pwptr = (*C.uint8_t)(&pw[0])
+
+		if PreAuthHook != nil {
+			uid, _ := hex.DecodeString(tag.UID())
+			err := PreAuthHook(uid)
+			if err != nil {
+				return "", err
+			}
+		}
 	}
 
+	start := time.Now()
 	r, err := C.openkey_authenticator_card_authenticate_pw(
 		*c.cptr, tagptr(tag), &cid, pwptr, C.size_t(len(pw)))
+	c.reportTiming("AuthenticateCard", time.Since(start))
 
 	if r >= 0 {
 		str := C.GoString(cid)
 		C.free(unsafe.Pointer(cid))
-		return str, nil
+		span.SetAttribute("card_id", str)
+		return str, c.checkCardID(str)
+	}
+
+	raw := c.rawErrors()
+	if r == -3 && !raw {
+		var ld *lockData
+		base, berr := c.basePath(CardAuthenticator)
+		if berr == nil {
+			ld, _ = readLockData(base)
+		}
+
+		id, cerr := classifyAuthFailure(tag, ld, pw)
+		if cerr == ErrWrongPassword && len(pw) == 0 {
+			pw, err = c.askPassword(id)
+			if err != nil {
+				return "", err
+			}
+
+			if len(pw) > 0 {
+				return c.authenticateCard(tag, pw)
+			}
+		}
+
+		if cerr == ErrNotOpenkeyCard && OnForeignCard != nil {
+			uid, _ := hex.DecodeString(tag.UID())
+			OnForeignCard(uid)
+		}
+
+		if cerr != nil {
+			return "", cerr
+		}
 	}
 
-	if err != nil && (r == -2 || r == -3) {
-		return "", tag.TranslateError(err)
+	// the libopenkey returns -2 if connecting fails and -3 for all
+	// failures while authenticating, be it selecting the application,
+	// authenticating with a key, or reading a file, so the command that
+	// failed is not known in the latter case
+	if err != nil && !raw && r == -2 {
+		return "", commandError("mifare_desfire_connect", tag.TranslateError(err))
+	} else if err != nil && !raw && r == -3 {
+		return "", &StepError{"authenticate card", tag.TranslateError(err)}
 	}
 
 	return "", Error(-r)
 }
 
+// If not nil, this function is called before each authentication with a
+// password by AuthenticateCard() with the UID the card presented during
+// anti-collision. If it returns an error, authentication is aborted before
+// the card is talked to and the error is returned. Use this hook to limit the
+// number of password attempts per card, returning ErrRateLimited if a card has
+// had too many attempts. Notice that cards with random UID enabled present a
+// different UID each time they are selected. Set this variable before using
+// any context; the hook may be called from multiple goroutines at once.
+var PreAuthHook func(cardUID []byte) error
+
+// If not nil, this function is called by AuthenticateCard() with the UID the
+// card presented during anti-collision whenever it finds that a card carries
+// no openkey applications, right before returning ErrNotOpenkeyCard. Use this
+// hook to tell cards tapped by mistake, e.g. transit cards, apart from failed
+// authentications. Set this variable before using any context; the hook may
+// be called from multiple goroutines at once.
+var OnForeignCard func(uid []byte)
+
+// The clock used by this package to tell the time of day, e.g. for the time
+// stamps of AuthEvent, the list of issued cards, and the production log, and
+// for the debouncing done by AuthStream(). Tests may replace it with a fake
+// clock to make time-dependent behavior deterministic. The durations reported
+// to the timing function and by Enroll() and BenchmarkAuth() are measured with
+// the monotonic clock and are not affected. Set this variable before using any
+// context; it may be called from multiple goroutines at once.
+var Now = time.Now
+
+// Authenticate the first of multiple tags that can be authenticated. The tags
+// are tried in order using AuthenticateCard(); the ID of the first card that
+// authenticates successfully is returned along with its tag. Before each
+// attempt, ctx is checked for cancellation and ctx.Err() is returned if it is
+// done. If ctx has no deadline, the operation timeout of c applies to each
+// attempt. Only if an attempt fails because of the card, e.g. because it is
+// not an openkey card or does not authenticate, is the next tag tried. If an
+// attempt times out or ctx is done during it, the attempt is abandoned as
+// described for SetOperationTimeout() and ErrTimeout or ctx.Err() is returned
+// right away without trying the remaining tags, as the abandoned attempt still
+// uses c and the reader. If no tag can be authenticated, the error of the last
+// attempt is returned. If tags is empty, ErrNoTags is returned.
+func (c Context) AuthenticateAny(ctx context.Context, tags []freefare.DESFireTag, pw []byte) (cardId string, matchedTag freefare.DESFireTag, err error) {
+	err = ErrNoTags
+	for _, tag := range tags {
+		if ctx.Err() != nil {
+			return "", freefare.DESFireTag{}, ctx.Err()
+		}
+
+		cardId, err = c.authenticateCardContext(ctx, tag, pw)
+		switch err {
+		case nil:
+			return cardId, tag, nil
+		case ErrTimeout, context.DeadlineExceeded, context.Canceled:
+			return "", freefare.DESFireTag{}, err
+		}
+	}
+
+	return "", freefare.DESFireTag{}, err
+}
+
+// Authenticate a card like AuthenticateCard() and check that it is the card
+// with ID expectedID. If the card authenticates but has a different ID,
+// ErrCardIDMismatch is returned. The card IDs are compared in constant time,
+// ignoring case. Errors from AuthenticateCard() are returned as is, including
+// ErrCardRevoked and ErrCardNotAllowed.
+func (c Context) AuthenticateExpected(tag freefare.DESFireTag, pw []byte, expectedID string) error {
+	cardId, err := c.AuthenticateCard(tag, pw)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(cardId), []byte(strings.ToLower(expectedID))) != 1 {
+		return ErrCardIDMismatch
+	}
+
+	return nil
+}
+
 // This function wraps the function openkey_kdf(). As a side-effect, this
 // function intializes the libgrypt as some of its functions are needed for this
-// function.
+// function; if that fails, ErrGcryptNotInitialized is returned. If the
+// libgcrypt runs out of secure memory, ErrSecMemExhausted is returned. The key
+// is written to derivedKey which remains owned by the caller; the wrapper does
+// not retain it. Use CloneKey() to keep a copy before reusing or overwriting
+// derivedKey. If masterKey, data, or derivedKey is empty, an *ArgumentError
+// naming it is returned.
 func Kdf(masterKey []byte, aid uint32, keyNo byte, data, derivedKey []byte) error {
-	initGcrypt()
+	err := checkNonEmpty([]string{"masterKey", "data", "derivedKey"}, masterKey, data, derivedKey)
+	if err != nil {
+		return err
+	}
 
-	r := C.openkey_kdf(
+	err = initGcrypt()
+	if err != nil {
+		return err
+	}
+
+	r, err := C.openkey_kdf(
 		(*C.uint8_t)(&masterKey[0]), C.size_t(len(masterKey)),
 		C.uint32_t(aid), C.uint8_t(keyNo),
 		(*C.uint8_t)(&data[0]), C.size_t(len(data)),
@@ -260,12 +995,17 @@ func Kdf(masterKey []byte, aid uint32, keyNo byte, data, derivedKey []byte) erro
 		return nil
 	}
 
-	return Error(-r)
+	return kdfError(r, err)
 }
 
 // This function wraps the function openkey_pbkdf(). As a side-effect, this
 // function intializes the libgcrypt as some of its functions are needed for
-// this function.
+// this function. As with Kdf(), derivedKey remains owned by the caller,
+// ErrGcryptNotInitialized is returned if the libgcrypt cannot be initialized,
+// and ErrSecMemExhausted is returned if it runs out of secure memory. If
+// masterKey, data, pw, or derivedKey is empty, an *ArgumentError naming it is
+// returned. The libopenkey uses Kdf() instead of Pbkdf() for cards without a
+// password, so an empty pw is never valid.
 func Pbkdf(
 	masterKey []byte,
 	aid uint32, keyNo byte,
@@ -273,9 +1013,17 @@ func Pbkdf(
 	iterations int,
 	derivedKey []byte,
 ) error {
-	initGcrypt()
+	err := checkNonEmpty([]string{"masterKey", "data", "pw", "derivedKey"}, masterKey, data, pw, derivedKey)
+	if err != nil {
+		return err
+	}
 
-	r := C.openkey_pbkdf(
+	err = initGcrypt()
+	if err != nil {
+		return err
+	}
+
+	r, err := C.openkey_pbkdf(
 		(*C.uint8_t)(&masterKey[0]), C.size_t(len(masterKey)),
 		C.uint32_t(aid), C.uint8_t(keyNo),
 		(*C.uint8_t)(&data[0]), C.size_t(len(data)),
@@ -287,21 +1035,211 @@ func Pbkdf(
 		return nil
 	}
 
+	return kdfError(r, err)
+}
+
+// Error returned by Kdf() and Pbkdf() if an argument that must not be empty
+// is. Name is the name of the argument. This error matches ErrInvalidArgument
+// with errors.Is().
+type ArgumentError struct {
+	Name string
+}
+
+func (e *ArgumentError) Error() string {
+	return "openkey: invalid argument: " + e.Name + " is empty"
+}
+
+// Report whether target is ErrInvalidArgument.
+func (e *ArgumentError) Is(target error) bool {
+	return target == ErrInvalidArgument
+}
+
+// Check that none of args is empty. names are the names of the arguments for
+// the *ArgumentError returned otherwise.
+func checkNonEmpty(names []string, args ...[]byte) error {
+	for i, arg := range args {
+		if len(arg) == 0 {
+			return &ArgumentError{names[i]}
+		}
+	}
+
+	return nil
+}
+
+// Translate the return value r and errno err of a failed call to openkey_kdf()
+// or openkey_pbkdf() into an error. The libgcrypt sets errno to ENOMEM if it
+// runs out of secure memory.
+func kdfError(r C.int, err error) error {
+	if err == syscall.ENOMEM {
+		return ErrSecMemExhausted
+	}
+
 	return Error(-r)
 }
 
+// The parameters Kdf() and Pbkdf() accept as reported by KdfCapabilities().
+// Only the low 24 bits of an AID are used for the derivation as DESFire AIDs
+// are 24 bits long; all key numbers can be used.
+type KdfCaps struct {
+	MinAID, MaxAID             uint32 // range of meaningful AIDs
+	MinKeyNo, MaxKeyNo         byte   // range of key numbers
+	MinKeyLength, MaxKeyLength int    // range of derived key lengths
+	DefaultIterations          int    // PBKDF2 iterations used by Pbkdf() if 0 is passed
+}
+
+// Report the parameters Kdf() and Pbkdf() accept. The maximum length of a
+// derived key is the output length of the hash function the linked libgcrypt
+// provides. Notice that the Go wrappers additionally require masterKey, data,
+// and derivedKey, as well as pw for Pbkdf(), to be non-empty. As a
+// side-effect, this function initializes the libgcrypt; if that fails,
+// ErrGcryptNotInitialized is returned as Kdf() and Pbkdf() would.
+func KdfCapabilities() (KdfCaps, error) {
+	err := initGcrypt()
+	if err != nil {
+		return KdfCaps{}, err
+	}
+
+	return KdfCaps{
+		MinAID:            0,
+		MaxAID:            0xffffff,
+		MinKeyNo:          0,
+		MaxKeyNo:          0xff,
+		MinKeyLength:      1,
+		MaxKeyLength:      int(C.gcry_md_get_algo_dlen(C.GCRY_MD_SHA256)),
+		DefaultIterations: 2048,
+	}, nil
+}
+
 // Get a pointer to the underlying MifareTag
 func tagptr(t freefare.DESFireTag) C.MifareTag {
 	return C.MifareTag(unsafe.Pointer(t.Pointer()))
 }
 
+// States of the libgcrypt initialization.
+const (
+	gcryptUninitialized = iota
+	gcryptReady
+	gcryptFailed
+	gcryptExternal
+)
+
 var gcryptOnce sync.Once
+var gcryptState = gcryptUninitialized
+
+// initialize the libgcrypt. The libgcrypt must be initialized exactly once
+// before it is used from multiple threads, so every entry point into code
+// using it must call this function first. Marking the initialization as
+// finished keeps openkey_init() from initializing the libgcrypt a second
+// time. If initialization fails, ErrGcryptNotInitialized is returned by this
+// and all subsequent calls; the libgcrypt must then not be used. If the
+// application initializes the libgcrypt, see ExternalGcryptInit(),
+// ErrGcryptNotInitialized is returned until it has done so.
+func initGcrypt() error {
+	gcryptOnce.Do(func() { doInitGcrypt(false) })
 
-// initialize the libgcrypt, panic if that fails
-func initGcrypt() {
-	gryptOnce.Do(func() {
-		if C.gcry_check_version(nil) == nil {
-			panic("Could not initilize libgcrypt")
+	switch gcryptState {
+	case gcryptReady:
+		return nil
+	case gcryptExternal:
+		if C.initialization_finished() != 0 {
+			return nil
 		}
+	}
+
+	return ErrGcryptNotInitialized
+}
+
+// Initialize the libgcrypt, disabling secure memory first if disableSecMem is
+// set. Must only be called through gcryptOnce.
+func doInitGcrypt(disableSecMem bool) {
+	if C.gcry_check_version(nil) == nil {
+		gcryptState = gcryptFailed
+		return
+	}
+
+	if disableSecMem {
+		C.disable_secmem()
+	}
+
+	C.finish_initialization()
+	gcryptState = gcryptReady
+}
+
+// Make the libgcrypt keep all key material in normal memory instead of secure
+// memory. Secure memory is locked into RAM so it is never swapped out, which
+// requires the CAP_IPC_LOCK capability or a sufficient RLIMIT_MEMLOCK; without
+// them, initializing the libgcrypt may fail on some systems and New() panics.
+// Disabling secure memory avoids this at the cost of keys possibly ending up
+// in swap space or core dumps. Only do this on systems without swap or with
+// encrypted swap. This function initializes the libgcrypt and must be called
+// before any other function of this package needing it. If the libgcrypt has
+// already been initialized or its initialization has been left to the
+// application with ExternalGcryptInit(), ErrGcryptInitialized is returned and
+// nothing is changed. If the initialization fails, ErrGcryptNotInitialized is
+// returned.
+func DisableSecureMemory() error {
+	done := false
+	gcryptOnce.Do(func() {
+		doInitGcrypt(true)
+		done = true
+	})
+
+	if !done {
+		return ErrGcryptInitialized
+	} else if gcryptState != gcryptReady {
+		return ErrGcryptNotInitialized
+	}
+
+	return nil
+}
+
+// Leave the initialization of the libgcrypt to the application. By default,
+// this package initializes the libgcrypt the first time it is needed, e.g. by
+// New() or Kdf(), calling gcry_check_version() and finishing the
+// initialization with GCRYCTL_INITIALIZATION_FINISHED. It does not install
+// thread callbacks: since version 1.6, the libgcrypt always uses pthreads and
+// ignores them. An application that uses the libgcrypt itself and needs to
+// configure it before initialization is finished, e.g. to set up secure
+// memory, should call this function before any other function of this
+// package and then initialize the libgcrypt on its own, including
+// GCRYCTL_INITIALIZATION_FINISHED. Until it has done so, the functions of
+// this package needing the libgcrypt return ErrGcryptNotInitialized and New()
+// panics. If this package has already initialized the libgcrypt,
+// ErrGcryptInitialized is returned and nothing is changed.
+func ExternalGcryptInit() error {
+	external := false
+	gcryptOnce.Do(func() {
+		gcryptState = gcryptExternal
+		external = true
 	})
+
+	if !external && gcryptState != gcryptExternal {
+		return ErrGcryptInitialized
+	}
+
+	return nil
+}
+
+// Report whether the libgcrypt operates in FIPS mode. FIPS mode is enabled
+// system-wide or through the environment before the libgcrypt is initialized;
+// see the libgcrypt manual for details. As a side-effect, this function
+// initializes the libgcrypt.
+func GcryptFIPSMode() bool {
+	if initGcrypt() != nil {
+		return false
+	}
+
+	return C.fips_mode_active() != 0
+}
+
+// Check that the libgcrypt operates in FIPS mode. Call this function during
+// initialization of a program that must only use FIPS compliant cryptography;
+// it returns ErrNoFIPSMode if FIPS mode is not active. As a side-effect, this
+// function initializes the libgcrypt.
+func RequireFIPS() error {
+	if !GcryptFIPSMode() {
+		return ErrNoFIPSMode
+	}
+
+	return nil
 }
@@ -46,6 +46,7 @@ extern int openkey_producer_card_recreate(openkey_context_t ctx, MifareTag tag,
 
 extern bool openkey_manager_is_bootstrapped(openkey_context_t ctx);
 extern int openkey_manager_bootstrap(openkey_context_t ctx, int preferred_slot);
+extern int openkey_manager_set_key_version(openkey_context_t ctx, uint8_t key_version);
 extern int openkey_manager_card_own(openkey_context_t ctx, MifareTag tag, int slot, const char *key_file);
 extern int openkey_manager_card_own_pw(openkey_context_t ctx, MifareTag tag, int slot, const char *key_file, const uint8_t *pw, size_t pw_length);
 #if 0
@@ -0,0 +1,235 @@
+package openkey
+
+import "bytes"
+import "io/ioutil"
+import "log/syslog"
+import "net"
+import "os"
+import "os/exec"
+import "strings"
+import "sync"
+import "testing"
+
+// Set in the environment of the process TestPbkdfConcurrentFirstUse() runs
+// itself in.
+const firstUseEnv = "OPENKEY_TEST_FIRST_USE"
+
+// Call Pbkdf() from many goroutines at once before anything else has
+// initialized the libgcrypt. As other tests may have done so already, the test
+// binary is run once more with just this test. Run with -race.
+func TestPbkdfConcurrentFirstUse(t *testing.T) {
+	if os.Getenv(firstUseEnv) == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPbkdfConcurrentFirstUse$")
+		cmd.Env = append(os.Environ(), firstUseEnv+"=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+
+		return
+	}
+
+	if gcryptState != gcryptUninitialized {
+		t.Fatal("libgcrypt initialized before first use")
+	}
+
+	const n = 100
+	keys := make([][]byte, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys[i] = make([]byte, 16)
+			errs[i] = Pbkdf([]byte("master key"), BaseAID, 2,
+				[]byte("card id"), []byte("password"), 0, keys[i])
+		}(i)
+	}
+
+	wg.Wait()
+
+	// this many derivations at once may exhaust the secure memory, which
+	// is reported as an error, not a crash
+	var want []byte
+	for i := range keys {
+		switch {
+		case errs[i] == ErrSecMemExhausted:
+			continue
+		case errs[i] != nil:
+			t.Fatalf("goroutine %d: %v", i, errs[i])
+		case want == nil:
+			want = keys[i]
+		case !bytes.Equal(keys[i], want):
+			t.Fatalf("goroutine %d derived a different key", i)
+		}
+	}
+
+	if want == nil {
+		t.Fatal("no goroutine derived a key")
+	}
+}
+
+// Report whether err is or wraps target like errors.Is(), which Go 1.12 lacks.
+func isError(err, target error) bool {
+	for err != nil {
+		if err == target {
+			return true
+		}
+
+		if is, ok := err.(interface{ Is(error) bool }); ok && is.Is(target) {
+			return true
+		}
+
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+
+		err = u.Unwrap()
+	}
+
+	return false
+}
+
+func TestKdfEmptyArguments(t *testing.T) {
+	some := []byte("x")
+	tests := []struct {
+		fn                              string
+		masterKey, data, pw, derivedKey []byte
+		name                            string
+	}{
+		{"Kdf", nil, some, nil, make([]byte, 16), "masterKey"},
+		{"Kdf", some, nil, nil, make([]byte, 16), "data"},
+		{"Kdf", some, some, nil, nil, "derivedKey"},
+		{"Kdf", some, some, nil, []byte{}, "derivedKey"},
+		{"Pbkdf", nil, some, some, make([]byte, 16), "masterKey"},
+		{"Pbkdf", some, []byte{}, some, make([]byte, 16), "data"},
+		{"Pbkdf", some, some, nil, make([]byte, 16), "pw"},
+		{"Pbkdf", some, some, []byte{}, make([]byte, 16), "pw"},
+		{"Pbkdf", some, some, some, nil, "derivedKey"},
+	}
+
+	for _, tt := range tests {
+		var err error
+		if tt.fn == "Kdf" {
+			err = Kdf(tt.masterKey, BaseAID, 0, tt.data, tt.derivedKey)
+		} else {
+			err = Pbkdf(tt.masterKey, BaseAID, 0, tt.data, tt.pw, 0, tt.derivedKey)
+		}
+
+		if !isError(err, ErrInvalidArgument) {
+			t.Errorf("%s with empty %s: got %v, want ErrInvalidArgument", tt.fn, tt.name, err)
+			continue
+		}
+
+		ae, ok := err.(*ArgumentError)
+		if !ok || ae.Name != tt.name {
+			t.Errorf("%s with empty %s: got %#v", tt.fn, tt.name, err)
+		}
+	}
+}
+
+// A negative length must be rejected before a worker tries to allocate the key.
+func TestDeriveKeysParallelNegativeLength(t *testing.T) {
+	specs := []KeySpec{
+		{AID: BaseAID, Data: []byte("x")},
+		{AID: BaseAID + 1, Data: []byte("x"), Length: -1},
+	}
+
+	keys, err := DeriveKeysParallel(make([]byte, 16), specs, 2)
+	if err != ErrInvalidArgument || keys != nil {
+		t.Errorf("got %v, %v, want ErrInvalidArgument", keys, err)
+	}
+}
+
+func TestCardPathLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	c, err := NewWithRole(CardProducer, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	// <dir>/<UID>-<name>/<name>-14
+	fixed := len(dir) + len("/00112233445566-") + len("/") + len("-14")
+	longest := (pathMax - 1 - fixed) / 2
+	for _, n := range []int{longest, longest + 1} {
+		name := strings.Repeat("x", n)
+		err := c.checkCardPathLength(name)
+		if n == longest && err != nil {
+			t.Errorf("card name of %d bytes rejected: %v", n, err)
+		} else if n > longest && !isError(err, ErrPathTooLong) {
+			t.Errorf("card name of %d bytes: got %v, want ErrPathTooLong", n, err)
+		}
+	}
+}
+
+// The settings shared by a context and its clones must be released once the
+// last of them has been closed, and only then.
+func TestCloseReleasesSharedState(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	c, err := NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone, err := c.clone()
+	if err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+
+	c.s.audit, err = syslog.Dial("udp", conn.LocalAddr().String(), syslog.LOG_AUTHPRIV|syslog.LOG_INFO, "openkey-test")
+	if err != nil {
+		clone.Close()
+		c.Close()
+		t.Fatal(err)
+	}
+
+	c.SetDedicatedThread(true)
+	thread := c.s.thread
+
+	err = clone.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.s.audit == nil || c.s.thread == nil {
+		t.Error("closing a clone released the shared settings")
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.s.audit != nil {
+		t.Error("closing the last context did not close the system log")
+	}
+
+	select {
+	case <-thread.quit:
+	default:
+		t.Error("closing the last context did not stop the dedicated thread")
+	}
+
+	c.Close()
+	if c.s.refs != 0 {
+		t.Errorf("%d references left after closing twice", c.s.refs)
+	}
+}
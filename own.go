@@ -0,0 +1,316 @@
+package openkey
+
+import "context"
+import "strconv"
+import "strings"
+
+import "github.com/clausecker/freefare"
+
+// Check whether ManagerOwnCard() would succeed without writing anything to
+// the card or the key store. The arguments are the same as for
+// ManagerOwnCard(). This function checks that the manager has been
+// bootstrapped, that keyFile is a valid transport key file, that a key can be
+// derived from pw, and that the application of slot on tag accepts the
+// transport keys of keyFile and carries the card ID recorded in it. If slot is
+// -1, the slots are tried in the same order as ManagerOwnCard() does and the
+// check succeeds if any of them passes.
+//
+// The errors mirror those of ManagerOwnCard(): Error(1) if the manager has not
+// been bootstrapped or slot is invalid, ErrOwnLoadTransportData if keyFile
+// cannot be used, and the errors from the tag if connecting or authenticating
+// fails. If the application carries a different card ID than keyFile,
+// ErrCardIDMismatch is returned. Since the password is only set but not
+// checked when owning a card, any password is accepted that a key can be
+// derived from. Whether the transport key file can be copied into the key
+// store is not checked. tag must be inactive.
+func (c Context) ManagerOwnCardDryRun(tag freefare.DESFireTag, slot int, keyFile string, pw []byte) error {
+	base, err := c.basePath(LockManager)
+	if err != nil {
+		return err
+	}
+
+	ld, err := readLockData(base)
+	if err != nil || ld == nil || !c.IsManagerBootstrapped() {
+		return Error(1)
+	}
+
+	if slot != -1 && (slot < SlotMin || slot > SlotMax) {
+		return Error(1)
+	}
+
+	td, err := readTransportData(keyFile)
+	if err != nil {
+		return ErrOwnLoadTransportData
+	}
+
+	err = tag.Connect()
+	if err != nil {
+		return err
+	}
+
+	defer tag.Disconnect()
+
+	slots := []int{slot}
+	if slot == -1 {
+		slots = ownSlotOrder(keyFile, ld)
+	}
+
+	err = Error(1)
+	for _, slot := range slots {
+		err = checkTransportKeys(tag, slot, td)
+		if err != nil {
+			continue
+		}
+
+		key, err := authenticationKey(ld.authenticationKey[:], slot, td.cardID, pw)
+		if err != nil {
+			return err
+		}
+
+		zero(key)
+		return nil
+	}
+
+	return err
+}
+
+// Own a card in slot like ManagerOwnCard() but only if the application of
+// slot is still free, i.e. still accepts the transport keys of keyFile. If it
+// does not, ErrSlotOccupied is returned and neither the card nor the key store
+// is touched; in particular, the transport key file copied into the key store
+// by whoever owned the card is left alone, which ManagerOwnCard() deletes when
+// it fails. The check and the ownership are performed as a single card
+// operation, so the operation timeout covers both and a dedicated thread runs
+// them back to back, but the card is selected anew in between. The protocol
+// offers no way to hold on to a card across the two, so a second station
+// owning the card in that window is not excluded; ManagerOwnCard() then fails
+// when authenticating with the transport keys. slot must not be -1; if it is
+// out of range, ErrInvalidSlot is returned. If keyFile cannot be read,
+// ErrOwnLoadTransportData is returned; if the application carries a different
+// card ID than keyFile, ErrCardIDMismatch. Other errors are as for
+// ManagerOwnCard(). tag must be inactive.
+func (c Context) ManagerOwnCardIfFree(tag freefare.DESFireTag, slot int, keyFile string, pw []byte) error {
+	if slot < SlotMin || slot > SlotMax {
+		return ErrInvalidSlot
+	}
+
+	td, err := readTransportData(keyFile)
+	if err != nil {
+		return ErrOwnLoadTransportData
+	}
+
+	return c.run(context.Background(), func() error {
+		err := slotFree(tag, slot, td)
+		if err != nil {
+			return err
+		}
+
+		return c.managerOwnCard(tag, slot, keyFile, pw)
+	})
+}
+
+// Check that the application of slot on tag accepts the transport keys from
+// td, returning ErrSlotOccupied if it does not. tag must be inactive.
+func slotFree(tag freefare.DESFireTag, slot int, td *transportData) error {
+	err := tag.Connect()
+	if err != nil {
+		return err
+	}
+
+	defer tag.Disconnect()
+
+	err = checkTransportKeys(tag, slot, td)
+	if err == freefare.Error(freefare.AuthenticationError) {
+		return ErrSlotOccupied
+	}
+
+	return err
+}
+
+// The order in which openkey_manager_card_own_pw() tries slots if none is
+// given: first the slot from the name of the transport key file, then the slots
+// from the lock data, then all remaining slots if the slot list ends in -1.
+func ownSlotOrder(keyFile string, ld *lockData) []int {
+	var slots []int
+	tried := make(map[int]bool)
+	try := func(slot int) {
+		if !tried[slot] {
+			tried[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+
+	if i := strings.LastIndexByte(keyFile, '-'); i >= 0 {
+		slot, err := strconv.Atoi(keyFile[i+1:])
+		if err == nil && slot >= SlotMin && slot <= SlotMax {
+			try(slot)
+		}
+	}
+
+	for _, slot := range ld.slots {
+		if slot != -1 {
+			try(slot)
+		}
+	}
+
+	if ld.slots[len(ld.slots)-1] == -1 {
+		for slot := SlotMin; slot <= SlotMax; slot++ {
+			try(slot)
+		}
+	}
+
+	return slots
+}
+
+// Check that the application of slot on tag carries the card ID from td and
+// accepts the transport keys from td. tag must be connected.
+func checkTransportKeys(tag freefare.DESFireTag, slot int, td *transportData) error {
+	id, err := readCardID(tag, slot, td.readKey[:])
+	if err != nil {
+		return err
+	}
+
+	if id != td.cardID {
+		return ErrCardIDMismatch
+	}
+
+	err = tag.Authenticate(3, *aesKey(td.updateKey[:]))
+	if err != nil {
+		return err
+	}
+
+	return tag.Authenticate(2, *aesKey(td.authenticationKey[:]))
+}
+
+// Maximum length of a card password accepted by ManagerChangeCardPassword().
+const maxPasswordLength = 64
+
+// Change the password of a card owned by the manager of c. The card must have
+// been owned in slot by this manager; pass -1 for slot to use the first slot
+// the manager can read the card ID from. oldPw is the current password, newPw
+// the new one; pass nil for either to mean "no password." Passwords may be at
+// most 64 bytes long, otherwise ErrInvalidPassword is returned. newPw is also
+// subject to the password policy of c, see SetPasswordPolicy().
+//
+// The authentication key of the application is changed in place, so the card
+// need not be owned again. If oldPw is wrong, ErrWrongPassword is returned
+// and the card is left unchanged. If the manager's keys cannot read the card,
+// ErrNotOpenkeyCard is returned. Errors from the tag are translated as usual.
+// tag must be inactive.
+func (c Context) ManagerChangeCardPassword(tag freefare.DESFireTag, slot int, oldPw, newPw []byte) error {
+	if len(newPw) > maxPasswordLength || len(oldPw) > maxPasswordLength {
+		return ErrInvalidPassword
+	}
+
+	if slot != -1 && (slot < SlotMin || slot > SlotMax) {
+		return ErrInvalidSlot
+	}
+
+	err := c.checkPasswordPolicy(newPw)
+	if err != nil {
+		return err
+	}
+
+	base, err := c.basePath(LockManager)
+	if err != nil {
+		return err
+	}
+
+	ld, err := readLockData(base)
+	if err != nil {
+		return err
+	} else if ld == nil {
+		return ErrNotBootstrapped
+	}
+
+	err = tag.Connect()
+	if err != nil {
+		return err
+	}
+
+	defer tag.Disconnect()
+
+	slots := []int{slot}
+	if slot == -1 {
+		slots, err = openkeySlots(tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, slot := range slots {
+		id, err := readCardID(tag, slot, ld.readKey[:])
+		if err != nil {
+			continue
+		}
+
+		return changeCardPassword(tag, ld, slot, id, oldPw, newPw)
+	}
+
+	return ErrNotOpenkeyCard
+}
+
+// Change the authentication key of the application of slot on the card with
+// ID cardID from the one derived from oldPw to the one derived from newPw. The
+// application must be selected. This works as the application settings allow
+// each key to be changed after authenticating with it.
+func changeCardPassword(tag freefare.DESFireTag, ld *lockData, slot int, cardID string, oldPw, newPw []byte) error {
+	oldKey, err := authenticationKey(ld.authenticationKey[:], slot, cardID, oldPw)
+	if err != nil {
+		return err
+	}
+
+	defer zero(oldKey)
+
+	newKey, err := authenticationKey(ld.authenticationKey[:], slot, cardID, newPw)
+	if err != nil {
+		return err
+	}
+
+	defer zero(newKey)
+
+	// keep the key version set by the manager owning the card
+	version, err := tag.KeyVersion(2)
+	if err != nil {
+		return err
+	}
+
+	err = tag.Authenticate(2, *aesKey(oldKey))
+	if _, ok := err.(freefare.Error); ok {
+		return ErrWrongPassword
+	} else if err != nil {
+		return err
+	}
+
+	var value [aesKeyLength]byte
+	copy(value[:], newKey)
+	defer zero(value[:])
+
+	return tag.ChangeKey(2, *freefare.NewDESFireAESKey(value, version), *aesKey(oldKey))
+}
+
+// Read the key version of key number keyNo of the application of slot on a
+// card. Key 0 is the application master key, key 1 the read key, key 2 the
+// authentication key, and key 3 the update key; see SetKeyVersion() for the
+// versions written. No authentication is needed. If slot is out of range,
+// ErrInvalidSlot is returned. Other errors come from the tag. tag must be
+// inactive.
+func CardKeyVersion(tag freefare.DESFireTag, slot int, keyNo byte) (byte, error) {
+	if slot < SlotMin || slot > SlotMax {
+		return 0, ErrInvalidSlot
+	}
+
+	err := tag.Connect()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tag.Disconnect()
+
+	err = tag.SelectApplication(slotAid(slot))
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.KeyVersion(keyNo)
+}
@@ -0,0 +1,177 @@
+package openkey
+
+import "strings"
+
+import "github.com/clausecker/freefare"
+
+// A function asked for the password of the card with ID cardID. If it returns
+// an error, the operation requiring the password fails with that error.
+type PasswordFunc func(cardID string) ([]byte, error)
+
+// Set a function to ask for card passwords when needed. If AuthenticateCard()
+// is called without a password and finds that the card has one, it calls f
+// with the card ID and retries authentication with the password returned. This
+// way, passwords need only be asked for cards that actually have one. f is
+// called synchronously on the goroutine calling AuthenticateCard() (unless an
+// operation timeout is in effect, see SetOperationTimeout()) and at most once
+// per call. If f returns an empty password, ErrWrongPassword is returned
+// as if no password function had been set. Pass nil to stop asking for
+// passwords.
+func (c Context) SetPasswordFunc(f PasswordFunc) {
+	c.s.mu.Lock()
+	c.s.password = f
+	c.s.mu.Unlock()
+}
+
+// Ask the password function of c for the password of the card with ID cardID.
+// If c has no password function, nil is returned.
+func (c Context) askPassword(cardID string) ([]byte, error) {
+	c.s.mu.RLock()
+	f := c.s.password
+	c.s.mu.RUnlock()
+
+	if f == nil {
+		return nil, nil
+	}
+
+	return f(cardID)
+}
+
+// Check whether pw is the password of a card owned for the lock of c's
+// authenticator role. Pass nil to check whether the card has no password.
+// This is lighter than AuthenticateCard() as only the authentication key of
+// the card is tried; the card's authenticity is not verified and neither the
+// revocation list nor the allow list are consulted. A wrong password yields
+// false and a nil error; ErrNotOpenkeyCard is returned if the card has no
+// application c can read. Other errors come from the tag. tag must be inactive.
+func (c Context) CheckPassword(tag freefare.DESFireTag, pw []byte) (bool, error) {
+	base, err := c.basePath(CardAuthenticator)
+	if err != nil {
+		return false, err
+	}
+
+	ld, err := readLockData(base)
+	if err != nil {
+		return false, err
+	} else if ld == nil {
+		return false, ErrNotBootstrapped
+	}
+
+	err = tag.Connect()
+	if err != nil {
+		return false, err
+	}
+
+	defer tag.Disconnect()
+
+	slots, err := openkeySlots(tag)
+	if err != nil {
+		return false, err
+	}
+
+	_, ok, err := checkPassword(tag, slots, ld, pw)
+	return ok, err
+}
+
+// Report whether a card owned for the lock of c's authenticator role has a
+// password, e.g. to decide whether to ask for one before authenticating. The
+// key settings of an openkey application are the same with and without a
+// password as the password only enters the derivation of the authentication
+// key. Hence the card cannot tell by itself; instead, this function checks
+// whether the card accepts the authentication key derived without a password,
+// see CheckPassword(). Errors are the same as for CheckPassword(). tag must be
+// inactive.
+func (c Context) CardIsPasswordProtected(tag freefare.DESFireTag) (bool, error) {
+	ok, err := c.CheckPassword(tag, nil)
+	if err != nil {
+		return false, err
+	}
+
+	return !ok, nil
+}
+
+// A policy for card passwords, see Context.SetPasswordPolicy().
+type PasswordPolicy struct {
+	// minimum and maximum length of a password in bytes. If MaxLength is
+	// 0 or more than 64, the limit of 64 bytes the package imposes applies.
+	MinLength, MaxLength int
+
+	// the bytes passwords may consist of or "" to allow all bytes
+	Allowed string
+}
+
+// Check pw against p. Passwords longer than MaxLength yield
+// ErrPasswordTooLong, shorter than MinLength ErrPasswordTooShort. Bytes not
+// in Allowed yield ErrPasswordBadByte.
+func (p PasswordPolicy) Validate(pw []byte) error {
+	max := p.MaxLength
+	if max <= 0 || max > maxPasswordLength {
+		max = maxPasswordLength
+	}
+
+	switch {
+	case len(pw) > max:
+		return ErrPasswordTooLong
+	case len(pw) < p.MinLength:
+		return ErrPasswordTooShort
+	}
+
+	if p.Allowed != "" {
+		for _, b := range pw {
+			if strings.IndexByte(p.Allowed, b) < 0 {
+				return ErrPasswordBadByte
+			}
+		}
+	}
+
+	return nil
+}
+
+// Set the password policy of c. If p is not nil, ManagerOwnCard(),
+// AuthenticateCard() (including passwords from the password function), and
+// ManagerChangeCardPassword() (for the new password) reject passwords that do
+// not pass p.Validate() with the error from it before touching the card. The
+// empty password, meaning "no password," is not subject to the policy. Pass
+// nil to remove the policy.
+func (c Context) SetPasswordPolicy(p *PasswordPolicy) {
+	if p != nil {
+		policy := *p
+		p = &policy
+	}
+
+	c.s.mu.Lock()
+	c.s.policy = p
+	c.s.mu.Unlock()
+}
+
+// Check pw against the password policy of c. If c has no password policy, only
+// the length limit of 64 bytes is checked. The empty password always passes.
+func (c Context) ValidatePassword(pw []byte) error {
+	c.s.mu.RLock()
+	p := c.s.policy
+	c.s.mu.RUnlock()
+
+	if p == nil {
+		p = &PasswordPolicy{}
+	}
+
+	if len(pw) == 0 {
+		return nil
+	}
+
+	return p.Validate(pw)
+}
+
+// Check pw against the password policy of c if it has one, as done by the
+// card operations subject to it.
+func (c Context) checkPasswordPolicy(pw []byte) error {
+	c.s.mu.RLock()
+	p := c.s.policy
+	c.s.mu.RUnlock()
+
+	if p == nil || len(pw) == 0 {
+		return nil
+	}
+
+	return p.Validate(pw)
+}
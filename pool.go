@@ -0,0 +1,81 @@
+package openkey
+
+import "sync"
+
+// A pool of contexts for use by concurrent goroutines. A Context must not be
+// used by multiple goroutines at once; instead of serializing all operations
+// on a single context, goroutines can take a context from a pool, use it, and
+// return it afterwards. All contexts of a pool have the same role added with
+// the same base path. Contexts are created as needed and kept for reuse when
+// returned. It is safe to use a pool from multiple goroutines.
+type Pool struct {
+	role Role
+	path string
+
+	mu     sync.Mutex
+	idle   []Context
+	closed bool
+}
+
+// Create a pool of contexts with role added with base path path. No contexts
+// are created until the first call to Get().
+func NewPool(role Role, path string) *Pool {
+	return &Pool{role: role, path: path}
+}
+
+// Take a context from the pool. If no idle context is available, a new one is
+// created with NewWithRole() and its errors are returned.
+// If the pool has been closed, ErrPoolClosed is returned. Return the context
+// with Put() when done.
+func (p *Pool) Get() (Context, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return Context{}, ErrPoolClosed
+	}
+
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+
+	p.mu.Unlock()
+
+	return NewWithRole(p.role, p.path)
+}
+
+// Return a context obtained from Get() to the pool. The context must not be
+// used afterwards. If the pool has been closed, the context is closed.
+func (p *Pool) Put(c Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		c.Close()
+		return
+	}
+
+	p.idle = append(p.idle, c)
+}
+
+// Close the pool and all idle contexts in it. Contexts currently taken from the
+// pool are closed when they are returned with Put(). Closing a pool twice
+// yields ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	p.closed = true
+	for _, c := range p.idle {
+		c.Close()
+	}
+
+	p.idle = nil
+	return nil
+}
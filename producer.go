@@ -0,0 +1,186 @@
+package openkey
+
+import "bufio"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/hex"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "time"
+
+// Layout of the time stamps in the producer's log.
+const producerLogTime = "2006-01-02 15:04:05"
+
+// An entry in the producer's log. The libopenkey appends an entry to the log
+// each time it writes a card, i.e. on both creation and recreation.
+type ProducedCard struct {
+	Time time.Time // when the card was written, with a resolution of seconds
+	UID  []byte    // the real UID of the card
+	Name string    // the card name after sanitation
+}
+
+// Sanitize a card name the way the libopenkey does before storing it. Bytes
+// other than ASCII letters, digits, dash, underscore, and space are replaced
+// with an underscore. The card name is not stored on the card itself but in
+// the producer's log and in the names of the transport key files.
+func SanitizeCardName(cardName string) string {
+	name := []byte(cardName)
+	for i, b := range name {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		case b == '-', b == '_', b == ' ':
+		default:
+			name[i] = '_'
+		}
+	}
+
+	return string(name)
+}
+
+// Read the log the producer keeps of the cards it has written. The entries are
+// returned in the order they were written. This can be used to check that a
+// call to ProducerCardCreate() or ProducerCardRecreate() actually wrote the
+// requested card name: the last entry then carries the sanitized name. If the
+// producer has not written any cards yet, an empty slice is returned. If the
+// producer role has not been added to c, ErrRoleNotAdded is returned.
+// Malformed entries yield ErrMalformedLog.
+func (c Context) ProducerLog() ([]ProducedCard, error) {
+	base, err := c.basePath(CardProducer)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(base, producerLogName))
+	if os.IsNotExist(err) {
+		return []ProducedCard{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	cards := []ProducedCard{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), " ", 4)
+		if len(fields) != 4 {
+			return nil, ErrMalformedLog
+		}
+
+		t, err := time.Parse(producerLogTime, fields[0]+" "+fields[1])
+		if err != nil {
+			return nil, ErrMalformedLog
+		}
+
+		uid, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, ErrMalformedLog
+		}
+
+		cards = append(cards, ProducedCard{t, uid, fields[3]})
+	}
+
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+
+	return cards, nil
+}
+
+// Count the cards the producer of c has issued, i.e. the distinct real UIDs in
+// its log. Recreating a card does not count as issuing another card, even if
+// the card gets a new name. As the libopenkey writes the log entry as the last
+// step of writing a card, the count includes every card written successfully,
+// regardless of what the caller did afterwards. Errors are the same as for
+// ProducerLog().
+func (c Context) ProducerIssuedCount() (uint64, error) {
+	log, err := c.ProducerLog()
+	if err != nil {
+		return 0, err
+	}
+
+	uids := make(map[string]bool, len(log))
+	for _, card := range log {
+		uids[string(card.UID)] = true
+	}
+
+	return uint64(len(uids)), nil
+}
+
+// Compute the path of the transport key file the producer of c writes for the
+// application of slot when creating a card with the given real UID and card
+// name. This is the file to pass as keyFile to ManagerOwnCard(), after it has
+// been copied to the manager's machine if necessary. The file lives in a
+// directory named after the card's UID and sanitized name below the
+// producer's base path:
+//
+//	<producer base path>/<UID in hex>-<name>/<name>-<slot>
+//
+// The UID and name of the cards produced can be taken from ProducerLog(). If
+// the producer role has not been added to c, ErrRoleNotAdded is returned. If
+// slot is out of range, ErrInvalidSlot is returned.
+func (c Context) TransportKeyFilePath(uid []byte, cardName string, slot int) (string, error) {
+	base, err := c.basePath(CardProducer)
+	if err != nil {
+		return "", err
+	}
+
+	if slot < SlotMin || slot > SlotMax {
+		return "", ErrInvalidSlot
+	}
+
+	name := SanitizeCardName(cardName)
+	dir := strings.ToUpper(hex.EncodeToString(uid)) + "-" + name
+	return filepath.Join(base, dir, name+"-"+strconv.Itoa(slot)), nil
+}
+
+// Diversification data used to derive producer fingerprints.
+const fingerprintData = "libopenkey producer fingerprint"
+
+// Compute a fingerprint of the producer identity of c, i.e. of its master key.
+// Two producers have the same fingerprint if and only if they have the same
+// master key and thus create cards with the same keys. The fingerprint is
+// derived from the master key with Kdf() and does not reveal it. If the
+// producer role has not been added to c, ErrRoleNotAdded is returned; if it has
+// not been bootstrapped, ErrNotBootstrapped is returned.
+func (c Context) ProducerFingerprint() ([]byte, error) {
+	base, err := c.basePath(CardProducer)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, aesKeyLength)
+	defer zero(key)
+
+	err = readProducerKey(base, key)
+	if err != nil {
+		return nil, err
+	}
+
+	fp := make([]byte, sha256.Size)
+	err = Kdf(key, 0, 0, []byte(fingerprintData), fp)
+	if err != nil {
+		return nil, err
+	}
+
+	return fp, nil
+}
+
+// Check whether a and b have the same producer identity by comparing their
+// fingerprints in constant time. Errors from ProducerFingerprint() are
+// returned.
+func SameProducer(a, b Context) (bool, error) {
+	fpa, err := a.ProducerFingerprint()
+	if err != nil {
+		return false, err
+	}
+
+	fpb, err := b.ProducerFingerprint()
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(fpa, fpb) == 1, nil
+}
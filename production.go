@@ -0,0 +1,106 @@
+package openkey
+
+import "encoding/hex"
+import "encoding/json"
+import "os"
+import "path/filepath"
+import "time"
+
+// Name of the production log file in the directory set with
+// SetProductionLog().
+const productionLogName = "production.jsonl"
+
+// A record in the production log. See SetProductionLog() for the format.
+type productionRecord struct {
+	Time     time.Time `json:"time"`
+	UID      string    `json:"uid"`
+	Name     string    `json:"name"`
+	CardIDs  []string  `json:"card_ids"`
+	Producer string    `json:"producer"`
+}
+
+// Keep a production log in directory dir. Each time ProducerCardCreate()
+// succeeds, a line with a JSON object is appended to the file
+// "production.jsonl" in dir, e.g.
+//
+//	{"time":"2006-01-02T15:04:05Z","uid":"04a1b2c3d4e5f6","name":"card 1",
+//	 "card_ids":["0ff2a8c4-...",...],"producer":"9c3d6a1e..."}
+//
+// (without the line break) holding the time the card was written, its real
+// UID, its sanitized name, the card IDs of its applications in order of their
+// slots, and the producer fingerprint as returned by ProducerFingerprint().
+// This gives a trail of the cards produced that is independent of the
+// producer's key store. If writing the record fails, the card operation
+// returns the error even though the card has been produced. Pass "" to stop
+// keeping a production log. dir must exist.
+func (c Context) SetProductionLog(dir string) {
+	c.s.mu.Lock()
+	c.s.productionLog = dir
+	c.s.mu.Unlock()
+}
+
+// Append a record for the card just produced with cardName to the production
+// log if one is kept.
+func (c Context) recordProduced(cardName string) error {
+	c.s.mu.RLock()
+	dir := c.s.productionLog
+	c.s.mu.RUnlock()
+
+	if dir == "" {
+		return nil
+	}
+
+	log, err := c.ProducerLog()
+	if err != nil {
+		return err
+	} else if len(log) == 0 {
+		return ErrMalformedLog
+	}
+
+	last := log[len(log)-1]
+	rec := productionRecord{
+		Time: Now().UTC(),
+		UID:  hex.EncodeToString(last.UID),
+		Name: last.Name,
+	}
+
+	for slot := SlotMin; slot <= SlotMax; slot++ {
+		keyFile, err := c.TransportKeyFilePath(last.UID, cardName, slot)
+		if err != nil {
+			return err
+		}
+
+		td, err := readTransportData(keyFile)
+		if err != nil {
+			return err
+		}
+
+		rec.CardIDs = append(rec.CardIDs, td.cardID)
+	}
+
+	fp, err := c.ProducerFingerprint()
+	if err != nil {
+		return err
+	}
+
+	rec.Producer = hex.EncodeToString(fp)
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, productionLogName),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,116 @@
+package openkey
+
+import "strings"
+import "time"
+
+import "github.com/clausecker/freefare"
+import "github.com/clausecker/nfc/v2"
+
+// Report whether err indicates that the reader, not the card, has failed, so
+// that the reader is unlikely to work again until it has been reset with
+// ResetReader(). This is the case if err is or wraps an nfc.Error reporting an
+// input/output error, an internal error of the reader's chip, or a missing
+// device. Errors caused by the card, such as failed RF transmissions or
+// timeouts when the card is pulled from the reader, are not considered. Errors
+// wrapping another error, such as *StepError, are unwrapped with their
+// Unwrap() method.
+func ReaderNeedsReset(err error) bool {
+	for err != nil {
+		if code, ok := err.(nfc.Error); ok {
+			switch code {
+			case nfc.EIO, nfc.ECHIP, nfc.ENOTSUCHDEV:
+				return true
+			default:
+				return false
+			}
+		}
+
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+
+		err = u.Unwrap()
+	}
+
+	return false
+}
+
+// Reset the reader dev after ReaderNeedsReset() reported an error. Any
+// command still running is aborted and the reader is initialized as an
+// initiator once more, which resets its settings and briefly drops the RF
+// field. Tags obtained from dev before the reset must be detected again. If
+// the reset fails, the error from the libnfc is returned; the reader then
+// has to be closed and reopened with nfc.Open(dev.Connection()), which may
+// require the reader to be reconnected first. No card operation must be in
+// progress on dev while it is reset.
+func ResetReader(dev nfc.Device) error {
+	// fails if no command is running
+	dev.AbortCommand()
+
+	return dev.InitiatorInit()
+}
+
+// The outcome of testing a reader with CommissionReaders().
+type CommissionResult struct {
+	Connection string        // connection string of the reader
+	CardID     string        // ID of the card found, if known
+	Latency    time.Duration // time taken to authenticate the card
+	Err        error         // nil if the reader passed
+}
+
+// Test each of devs by authenticating the test card with ID testCardID on it,
+// e.g. when commissioning a site. The test card must be owned for the
+// authenticator's lock without a password and rest on each reader when it is
+// tested; the readers are tested one after another in order, so the same card
+// can be moved from reader to reader or each reader can have a test card of
+// its own with the same ID. A reader passes if it finds a Mifare DESFire card
+// and AuthenticateCard() authenticates it as the test card. The results are
+// returned in the order of devs. If a reader finds no DESFire card, its result
+// carries ErrNoTags; if it finds a card with another ID, ErrCardIDMismatch.
+// Other errors come from freefare.GetTags() and AuthenticateCard(). Latency is
+// the time taken to authenticate the card.
+// If no authenticator role has been added to c, ErrRoleNotAdded is returned
+// and no reader is tested.
+func (c Context) CommissionReaders(devs []nfc.Device, testCardID string) ([]CommissionResult, error) {
+	_, err := c.basePath(CardAuthenticator)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]CommissionResult, len(devs))
+	for i, dev := range devs {
+		results[i] = c.commissionReader(dev, testCardID)
+	}
+
+	return results, nil
+}
+
+// Test the reader dev for CommissionReaders().
+func (c Context) commissionReader(dev nfc.Device, testCardID string) CommissionResult {
+	res := CommissionResult{Connection: dev.Connection()}
+
+	tags, err := freefare.GetTags(dev)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	for _, tag := range tags {
+		if tag.Type() != freefare.DESFire {
+			continue
+		}
+
+		start := time.Now()
+		res.CardID, res.Err = c.AuthenticateCard(tag.(freefare.DESFireTag), nil)
+		res.Latency = time.Since(start)
+		if res.Err == nil && res.CardID != strings.ToLower(testCardID) {
+			res.Err = ErrCardIDMismatch
+		}
+
+		return res
+	}
+
+	res.Err = ErrNoTags
+	return res
+}
@@ -0,0 +1,318 @@
+package openkey
+
+import "bufio"
+import "bytes"
+import "encoding/json"
+import "io/ioutil"
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+
+// Error returned by LoadRevocationList(), ReloadRevocationList(), and the
+// corresponding methods of RevocationList if the revocation list is malformed.
+// Line is the number of the offending line, starting at 1.
+type RevocationListError struct {
+	Path string
+	Line int
+	Msg  string
+}
+
+func (e *RevocationListError) Error() string {
+	return "openkey: " + e.Path + ":" + strconv.Itoa(e.Line) + ": " + e.Msg
+}
+
+// A list of revoked card IDs. A revocation list can be shared by multiple
+// contexts, see Context.UseRevocationList(), so all authenticators of a
+// process reject the same cards. Updates replace the list atomically: card
+// operations in progress see either the old or the new list, and checking a
+// card ID never waits for an update to finish. It is safe to use a revocation
+// list from multiple goroutines. The zero value is an empty list.
+type RevocationList struct {
+	mu sync.Mutex   // serializes updates
+	v  atomic.Value // the current *revocationSet
+}
+
+// The contents of a RevocationList: the revoked card IDs in lower case and
+// the file they were loaded from or "" if they were set directly.
+type revocationSet struct {
+	ids  map[string]bool
+	path string
+}
+
+// Create a revocation list holding the card IDs in ids.
+func NewRevocationList(ids []string) *RevocationList {
+	l := new(RevocationList)
+	l.Set(ids)
+	return l
+}
+
+// Replace the card IDs in l with ids. Pass nil to clear the list. Card IDs are
+// compared case-insensitively.
+func (l *RevocationList) Set(ids []string) {
+	l.mu.Lock()
+	l.set(ids, "")
+	l.mu.Unlock()
+}
+
+// Load the card IDs in l from the file path, replacing the current IDs as with
+// Set(). The file either contains one card ID per line or a JSON array of card
+// IDs. In the former format, empty lines and lines starting with # are
+// ignored. If the file is malformed, a *RevocationListError is returned and l
+// is left unchanged. path is remembered for Reload().
+func (l *RevocationList) Load(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.load(path)
+}
+
+// Read the file last loaded with Load() again, e.g. after it has been
+// updated. If no file has been loaded or the list has since been replaced with
+// Set(), ErrNoRevocationList is returned. On error, l is left unchanged.
+func (l *RevocationList) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	path := l.current().path
+	if path == "" {
+		return ErrNoRevocationList
+	}
+
+	return l.load(path)
+}
+
+// Report whether the card with ID id is on l.
+func (l *RevocationList) Revoked(id string) bool {
+	return l.current().ids[strings.ToLower(id)]
+}
+
+// The current contents of l.
+func (l *RevocationList) current() *revocationSet {
+	set, _ := l.v.Load().(*revocationSet)
+	if set == nil {
+		return &revocationSet{}
+	}
+
+	return set
+}
+
+// Replace the contents of l with ids, loaded from path. l.mu must be held.
+func (l *RevocationList) set(ids []string, path string) {
+	revoked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		revoked[strings.ToLower(id)] = true
+	}
+
+	l.v.Store(&revocationSet{revoked, path})
+}
+
+// Load the contents of l from path. l.mu must be held.
+func (l *RevocationList) load(path string) error {
+	ids, err := readRevocationList(path)
+	if err != nil {
+		return err
+	}
+
+	l.set(ids, path)
+	return nil
+}
+
+// Set the list of revoked card IDs. AuthenticateCard() rejects cards whose ID
+// is on this list with ErrCardRevoked after they have been authenticated. The
+// list replaces any previously set or loaded list; pass nil to clear it. Card
+// IDs are compared case-insensitively. It is safe to call this function while
+// other goroutines authenticate cards with c. If c uses a shared revocation
+// list, the shared list is changed.
+func (c Context) SetRevocationList(ids []string) {
+	c.revocationList().Set(ids)
+}
+
+// Load the list of revoked card IDs from the file path, replacing the current
+// list as with SetRevocationList(). The file format is described for
+// RevocationList.Load(). If the file is malformed, a *RevocationListError is
+// returned and the current list is left unchanged. path is remembered for
+// ReloadRevocationList().
+func (c Context) LoadRevocationList(path string) error {
+	return c.revocationList().Load(path)
+}
+
+// Read the file last loaded with LoadRevocationList() again, e.g. after it has
+// been updated. If no file has been loaded or the list has since been replaced
+// with SetRevocationList(), ErrNoRevocationList is returned. On error, the
+// current list is left unchanged.
+func (c Context) ReloadRevocationList() error {
+	return c.revocationList().Reload()
+}
+
+// Make c use the revocation list l, e.g. to share one list among several
+// contexts. Subsequent calls to SetRevocationList(), LoadRevocationList(), and
+// ReloadRevocationList() on c change l. Pass nil to give c a list of its own,
+// initially empty.
+func (c Context) UseRevocationList(l *RevocationList) {
+	if l == nil {
+		l = new(RevocationList)
+	}
+
+	c.s.mu.Lock()
+	c.s.revocation = l
+	c.s.mu.Unlock()
+}
+
+// The revocation list used by c. A list of its own is created if c does not
+// have one yet.
+func (c Context) revocationList() *RevocationList {
+	c.s.mu.RLock()
+	l := c.s.revocation
+	c.s.mu.RUnlock()
+
+	if l != nil {
+		return l
+	}
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	if c.s.revocation == nil {
+		c.s.revocation = new(RevocationList)
+	}
+
+	return c.s.revocation
+}
+
+// Read and parse the revocation list in file path.
+func readRevocationList(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return parseJSONRevocationList(path, data)
+	}
+
+	var ids []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; s.Scan(); line++ {
+		id := strings.TrimSpace(s.Text())
+		if id == "" || id[0] == '#' {
+			continue
+		}
+
+		if !isCardID(id) {
+			return nil, &RevocationListError{path, line, "malformed card ID " + strconv.Quote(id)}
+		}
+
+		ids = append(ids, id)
+	}
+
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+
+	return ids, nil
+}
+
+// Parse a revocation list in JSON format.
+func parseJSONRevocationList(path string, data []byte) ([]string, error) {
+	var ids []string
+	err := json.Unmarshal(data, &ids)
+	if err != nil {
+		var offset int64
+		switch jerr := err.(type) {
+		case *json.SyntaxError:
+			offset = jerr.Offset
+		case *json.UnmarshalTypeError:
+			offset = jerr.Offset
+		}
+
+		line := 1 + bytes.Count(data[:offset], []byte{'\n'})
+		return nil, &RevocationListError{path, line, err.Error()}
+	}
+
+	for i, id := range ids {
+		if !isCardID(id) {
+			offset := jsonElementOffset(data, i)
+			line := 1 + bytes.Count(data[:offset], []byte{'\n'})
+			return nil, &RevocationListError{path, line, "malformed card ID " + strconv.Quote(id)}
+		}
+	}
+
+	return ids, nil
+}
+
+// Find the offset of element n of the JSON array in data. data must be
+// well-formed and its elements must not be arrays or objects, as is the case
+// once json.Unmarshal() has decoded it into a []string. Searching for the
+// element's text instead would find earlier duplicates and miss elements
+// written with escape sequences.
+func jsonElementOffset(data []byte, n int) int {
+	elem := -1
+	inString, escaped := false, false
+	for i, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch b {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case b == '"':
+			if elem == n {
+				return i
+			}
+
+			inString = true
+		case b == '[' || b == ',':
+			elem++
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+		default:
+			if elem == n {
+				return i
+			}
+		}
+	}
+
+	return len(data)
+}
+
+// Restrict AuthenticateCard() to the card IDs in ids. Cards not on the list
+// are rejected with ErrCardNotAllowed after they have been authenticated. The
+// revocation list takes precedence: a card on both lists is rejected with
+// ErrCardRevoked. Pass nil to admit all cards again; an empty but non-nil
+// slice admits no card at all. Card IDs are compared case-insensitively. It is
+// safe to call this function while other goroutines authenticate cards with c.
+func (c Context) SetAllowList(ids []string) {
+	var allowed map[string]bool
+	if ids != nil {
+		allowed = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			allowed[strings.ToLower(id)] = true
+		}
+	}
+
+	c.s.mu.Lock()
+	c.s.allowed = allowed
+	c.s.mu.Unlock()
+}
+
+// Check whether the card with ID id may be admitted after it has been
+// authenticated. If not, an appropriate error is returned.
+func (c Context) checkCardID(id string) error {
+	if c.revocationList().Revoked(id) {
+		return ErrCardRevoked
+	}
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	if c.s.allowed != nil && !c.s.allowed[id] {
+		return ErrCardNotAllowed
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package openkey
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+import "testing"
+
+// Card IDs used by the revocation tests.
+var testCardIDs = [...]string{
+	"00000000-0000-4000-8000-000000000001",
+	"00000000-0000-4000-8000-000000000002",
+	"00000000-0000-4000-8000-000000000003",
+	"00000000-0000-4000-8000-000000000004",
+}
+
+// Write a revocation list with ids to path, replacing it atomically.
+func writeRevocationList(path string, ids []string) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(strings.Join(ids, "\n")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Swap the revocation list shared by two contexts and their allow lists while
+// other goroutines check card IDs against them. Run with -race.
+func TestRevocationListConcurrentSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	lists := [][]string{testCardIDs[:2], testCardIDs[2:]}
+	path := filepath.Join(dir, "revoked")
+	err = writeRevocationList(path, lists[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := new(RevocationList)
+	err = shared.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctxs [2]Context
+	for i := range ctxs {
+		ctxs[i], err = NewContext()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer ctxs[i].Close()
+		ctxs[i].UseRevocationList(shared)
+	}
+
+	const rounds = 200
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+
+	// swap the revocation list, alternately by reloading the file and
+	// through a context
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for i := 0; i < rounds; i++ {
+			ids := lists[i%2]
+			if i%4 < 2 {
+				err := writeRevocationList(path, ids)
+				if err == nil {
+					err = shared.Reload()
+				}
+
+				if err != nil {
+					errs <- err
+					return
+				}
+			} else {
+				ctxs[1].SetRevocationList(ids)
+				err := ctxs[1].LoadRevocationList(path)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+
+	// swap the allow list
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if i%2 == 0 {
+				ctxs[0].SetAllowList(testCardIDs[:1])
+			} else {
+				ctxs[0].SetAllowList(nil)
+			}
+		}
+	}()
+
+	// check card IDs, making sure each check sees a complete list
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				set := shared.current()
+				if len(set.ids) != 2 || set.ids[testCardIDs[0]] != set.ids[testCardIDs[1]] ||
+					set.ids[testCardIDs[0]] == set.ids[testCardIDs[2]] {
+					errs <- &RevocationListError{set.path, 0, "inconsistent list"}
+					return
+				}
+
+				for _, c := range ctxs {
+					for _, id := range testCardIDs {
+						err := c.checkCardID(id)
+						if err != nil && err != ErrCardRevoked && err != ErrCardNotAllowed {
+							errs <- err
+							return
+						}
+
+						shared.Revoked(strings.ToUpper(id))
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// Malformed card IDs in JSON revocation lists must be reported on the line of
+// the offending element, even if it is written with escape sequences or is
+// not a string.
+func TestParseJSONRevocationListLine(t *testing.T) {
+	id := testCardIDs[0]
+	tests := []struct {
+		name string
+		data string
+		line int
+	}{
+		{"plain", "[\n\"" + id + "\",\n\"bad\"\n]", 3},
+		{"escaped", "[\n\"" + id + "\",\n\"bad\\/id\"\n]", 3},
+		{"null", "[\n\"" + id + "\",\n\n null]", 4},
+		{"first", "[\"bad\",\n\"" + id + "\"]", 1},
+		{"comma", "[\"" + id + "\"\n,\"b,a\\\"d\", \"bad\"]", 2},
+	}
+
+	for _, tt := range tests {
+		_, err := parseJSONRevocationList("revoked.json", []byte(tt.data))
+		rerr, ok := err.(*RevocationListError)
+		if !ok {
+			t.Errorf("%s: got error %v, want *RevocationListError", tt.name, err)
+			continue
+		}
+
+		if rerr.Line != tt.line {
+			t.Errorf("%s: got line %d, want %d", tt.name, rerr.Line, tt.line)
+		}
+	}
+}
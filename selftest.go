@@ -0,0 +1,115 @@
+package openkey
+
+import "github.com/clausecker/freefare"
+
+// An error that occured during a multi-step operation such as SelfTestCard().
+// Step names the step that failed, Err is the error it failed with.
+type StepError struct {
+	Step string
+	Err  error
+}
+
+// Returns a string of the form "openkey: step: error".
+func (e *StepError) Error() string {
+	return "openkey: " + e.Step + ": " + e.Err.Error()
+}
+
+// Return the error the step failed with.
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Steps of SelfTestCard()
+const (
+	StepReadCardID   = "read card ID"
+	StepCardUID      = "get card UID"
+	StepDeriveKey    = "derive application key"
+	StepAuthenticate = "authenticate application"
+	StepOpenkeyAuth  = "openkey authentication"
+)
+
+// Check that a freshly owned card works end to end. masterKey is the master
+// key of the producer that created the card, slot is the slot the card has been
+// owned in for the lock of c's authenticator role. The card must not have a
+// password. SelfTestCard() performs the following steps, returning a
+// *StepError naming the first step that failed:
+//
+//	StepReadCardID    read the card ID with the lock's read key
+//	StepCardUID       retrieve the card's real UID
+//	StepDeriveKey     compute the application key with ExpectedCardKey()
+//	StepAuthenticate  authenticate the application with that key
+//	StepOpenkeyAuth   authenticate the card with AuthenticateCard() and
+//	                  compare the card ID
+//
+// tag must be inactive. If c has no authenticator role, ErrRoleNotAdded is
+// returned without touching the card.
+func (c Context) SelfTestCard(tag freefare.DESFireTag, masterKey []byte, slot int) error {
+	base, err := c.basePath(CardAuthenticator)
+	if err != nil {
+		return err
+	}
+
+	ld, err := readLockData(base)
+	if err != nil {
+		return err
+	} else if ld == nil {
+		return ErrNotBootstrapped
+	}
+
+	id, err := selfTestApplication(tag, masterKey, slot, ld)
+	if err != nil {
+		return err
+	}
+
+	authId, err := c.AuthenticateCard(tag, nil)
+	if err != nil {
+		return &StepError{StepOpenkeyAuth, err}
+	}
+
+	if authId != id {
+		return &StepError{StepOpenkeyAuth, ErrCardIDMismatch}
+	}
+
+	return nil
+}
+
+// Perform the steps of SelfTestCard() that talk to the card directly and
+// return the card ID read.
+func selfTestApplication(tag freefare.DESFireTag, masterKey []byte, slot int, ld *lockData) (string, error) {
+	err := tag.Connect()
+	if err != nil {
+		return "", &StepError{StepReadCardID, err}
+	}
+
+	defer tag.Disconnect()
+
+	id, err := readCardID(tag, slot, ld.readKey[:])
+	if err != nil {
+		return "", &StepError{StepReadCardID, err}
+	}
+
+	// we are authenticated with the read key, so the real UID is available
+	uid, err := RealCardUID(tag)
+	if err != nil {
+		return "", &StepError{StepCardUID, err}
+	}
+
+	key, err := ExpectedCardKey(uid, masterKey, slot)
+	if err != nil {
+		return "", &StepError{StepDeriveKey, err}
+	}
+
+	defer zero(key)
+
+	err = tag.SelectApplication(slotAid(slot))
+	if err != nil {
+		return "", &StepError{StepAuthenticate, err}
+	}
+
+	err = tag.Authenticate(0, *aesKey(key))
+	if err != nil {
+		return "", &StepError{StepAuthenticate, err}
+	}
+
+	return id, nil
+}
@@ -0,0 +1,112 @@
+package openkey
+
+import "context"
+import "time"
+
+import "github.com/clausecker/freefare"
+import "github.com/clausecker/nfc/v2"
+
+// How often AuthStream() polls the reader for cards.
+const authStreamPollInterval = 250 * time.Millisecond
+
+// An event reported by AuthStream(). If a card was authenticated, CardID is
+// its ID and Err is nil. Otherwise Err describes what went wrong; if a card
+// was involved, Tag is set.
+type AuthEvent struct {
+	CardID string
+	Tag    freefare.DESFireTag
+	Err    error
+	Time   time.Time
+}
+
+// Watch the reader dev for cards and authenticate each card tapped using
+// AuthenticateCard() without a password. An event is sent on the returned
+// channel for each card tapped and each error encountered while polling the
+// reader. The reader is polled until ctx is done, after which the channel is
+// closed. Events are not buffered: the polling goroutine waits for each event
+// to be received or ctx to be done.
+//
+// A card resting on the reader is reported once. If debounce is positive,
+// taps of the same card are also ignored until the card has been absent from
+// the reader for debounce. Cards are recognized by their card ID or, if they
+// could not be authenticated, their UID. As cards with random UID enabled
+// present a new UID each time they are selected, failed attempts on such cards
+// are reported each time the reader is polled.
+func (c Context) AuthStream(ctx context.Context, dev nfc.Device, debounce time.Duration) <-chan AuthEvent {
+	events := make(chan AuthEvent)
+	go c.authStream(ctx, dev, debounce, events)
+	return events
+}
+
+// The polling loop of AuthStream().
+func (c Context) authStream(ctx context.Context, dev nfc.Device, debounce time.Duration, events chan<- AuthEvent) {
+	defer close(events)
+
+	// when each card has last been seen. A card seen within window is
+	// considered to have rested on the reader. Allow for one missed poll.
+	seen := make(map[string]time.Time)
+	window := debounce + 2*authStreamPollInterval
+	send := func(ev AuthEvent) bool {
+		select {
+		case events <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// check whether the card known as key has rested on the reader and
+	// mark it as seen
+	rested := func(key string) bool {
+		last, ok := seen[key]
+		now := Now()
+		seen[key] = now
+		return ok && now.Sub(last) <= window
+	}
+
+	ticker := time.NewTicker(authStreamPollInterval)
+	defer ticker.Stop()
+
+	for {
+		tags, err := freefare.GetTags(dev)
+		if err != nil && !send(AuthEvent{Err: err, Time: Now()}) {
+			return
+		}
+
+		for _, tag := range tags {
+			if tag.Type() != freefare.DESFire {
+				continue
+			}
+
+			dtag := tag.(freefare.DESFireTag)
+			if rested("uid:" + dtag.UID()) {
+				continue
+			}
+
+			ev := AuthEvent{Tag: dtag, Time: Now()}
+			ev.CardID, ev.Err = c.authenticateCardContext(ctx, dtag, nil)
+			seen["uid:"+dtag.UID()] = Now()
+			if ev.Err == nil && rested("id:"+ev.CardID) {
+				continue
+			}
+
+			if ctx.Err() != nil || !send(ev) {
+				return
+			}
+		}
+
+		// forget cards that have been absent long enough
+		now := Now()
+		for key, last := range seen {
+			if now.Sub(last) > window {
+				delete(seen, key)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
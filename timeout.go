@@ -0,0 +1,184 @@
+package openkey
+
+import "context"
+import "runtime"
+import "time"
+
+import "github.com/clausecker/freefare"
+
+// Set a default time limit for card operations. If an operation does not
+// finish within d, it is abandoned and ErrTimeout is returned. Operations
+// taking a context.Context use its deadline instead if it has one. Pass 0 to
+// remove the time limit. This affects ProducerCardCreate(),
+// ProducerCardRecreate(), ManagerOwnCard(), AuthenticateCard(), and
+// AuthenticateAny().
+//
+// The libopenkey cannot be interrupted. To enforce a time limit, operations
+// run on a separate goroutine, and an abandoned operation continues in the
+// background until the card or the reader gives up. Until then, the tag and
+// c must not be used for anything else, and Close() waits for the operation
+// unless told otherwise with SetCloseMode(). Hooks such as the password
+// function are called on that goroutine, too.
+func (c Context) SetOperationTimeout(d time.Duration) {
+	c.s.mu.Lock()
+	c.s.timeout = d
+	c.s.mu.Unlock()
+}
+
+// Run card operations of c on a dedicated OS thread. Some configurations of
+// the libgcrypt and the libnfc keep thread-local state and misbehave if an
+// operation moves between OS threads or consecutive operations run on
+// different threads. If enable is true, a goroutine locked to its own OS
+// thread is started and ProducerCardCreate(), ProducerCardRecreate(),
+// ManagerOwnCard(), AuthenticateCard(), and AuthenticateAny() are dispatched
+// to it; pass false to stop the thread. The setting is shared with the
+// contexts cloned for a MultiReader, which then take turns on the thread.
+//
+// This is slower than the default: each operation is handed to the thread and
+// its result handed back, and operations on c are serialized even if they
+// come from different goroutines, waiting for each other. The operation
+// timeout applies while waiting for the thread, too. The thread is stopped
+// once c and the contexts cloned from it for a MultiReader have all been
+// closed.
+func (c Context) SetDedicatedThread(enable bool) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	switch {
+	case enable && c.s.thread == nil:
+		t := &osThread{make(chan func()), make(chan struct{})}
+		go t.loop()
+		c.s.thread = t
+	case !enable && c.s.thread != nil:
+		close(c.s.thread.quit)
+		c.s.thread = nil
+	}
+}
+
+// A goroutine locked to an OS thread running the functions sent on work until
+// quit is closed.
+type osThread struct {
+	work chan func()
+	quit chan struct{}
+}
+
+// The main loop of the goroutine of t.
+func (t *osThread) loop() {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	for {
+		select {
+		case f := <-t.work:
+			f()
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+// Run the card operation f, observing the operation timeout of c unless ctx
+// has a deadline of its own. If ctx is done or the timeout expires before f
+// returns, f is abandoned and ctx.Err() or ErrTimeout is returned. If c has a
+// dedicated thread, f is run on it.
+func (c Context) run(ctx context.Context, f func() error) error {
+	c.s.mu.RLock()
+	timeout := c.s.timeout
+	thread := c.s.thread
+	c.s.mu.RUnlock()
+
+	deadlineExceeded := ErrTimeout
+	if _, ok := ctx.Deadline(); ok {
+		deadlineExceeded = context.DeadlineExceeded
+	} else if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// keep Close() from releasing the context under f
+	c.ops.begin()
+
+	// nothing to observe, save the goroutine
+	if ctx.Done() == nil && thread == nil {
+		defer c.ops.end()
+		return f()
+	}
+
+	done := make(chan error, 1)
+	g := func() {
+		defer c.ops.end()
+		done <- f()
+	}
+
+	if thread == nil {
+		go g()
+	} else {
+		select {
+		case thread.work <- g:
+		case <-thread.quit:
+			// stopped in the meantime
+			go g()
+		case <-ctx.Done():
+			c.ops.end()
+		}
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return deadlineExceeded
+		}
+
+		return ctx.Err()
+	}
+}
+
+// AuthenticateCard() observing ctx as described for run().
+func (c Context) authenticateCardContext(ctx context.Context, tag freefare.DESFireTag, pw []byte) (string, error) {
+	// only read by us if f has returned
+	var cardId string
+	err := c.run(ctx, func() error {
+		var err error
+		cardId, err = c.authenticateCard(tag, pw)
+		return err
+	})
+
+	if err != nil && (err == ErrTimeout || err == ctx.Err()) {
+		c.auditAuthentication(tag, "", err)
+		return "", err
+	}
+
+	c.auditAuthentication(tag, cardId, err)
+	return cardId, err
+}
+
+// Like ProducerCardCreate() but abandon the operation once ctx is done. If
+// ctx has no deadline, the operation timeout of c applies. If ctx is done
+// before the card has been written, ctx.Err() or ErrTimeout is returned and
+// the operation continues in the background as described for
+// SetOperationTimeout().
+//
+// Writing a card is not atomic. A card pulled from the reader or an operation
+// abandoned midway may leave the card partially written: it may have some of
+// its applications or a changed PICC master key, and transport key files may
+// have been written for it. Check the last entry of ProducerLog() to see
+// whether the card has been written completely and use ProducerCardRecreate()
+// to write a partially written card again; DiagnoseCard() shows which
+// applications the card has.
+func (c Context) ProducerCardCreateContext(ctx context.Context, tag freefare.DESFireTag, cardName string) error {
+	return c.run(ctx, func() error {
+		return c.producerCardCreate(tag, cardName)
+	})
+}
+
+// Like ProducerCardRecreate() but abandon the operation once ctx is done, as
+// described for ProducerCardCreateContext(). The same caveat about partially
+// written cards applies.
+func (c Context) ProducerCardRecreateContext(ctx context.Context, tag freefare.DESFireTag, cardName, oldId string) error {
+	return c.run(ctx, func() error {
+		return c.producerCardRecreate(tag, cardName, oldId)
+	})
+}
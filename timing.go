@@ -0,0 +1,27 @@
+package openkey
+
+import "time"
+
+// Set a function to be called with the duration of each card operation. The
+// duration is measured around the call into the libopenkey, so it reflects the
+// time spent talking to the card but not any work done by the wrapper before
+// or afterwards. op is the name of the method, i.e. "AuthenticateCard",
+// "ManagerOwnCard", or "ProducerCardCreate". f is called synchronously from
+// the goroutine performing the operation, whether it succeeds or not. Pass nil
+// to stop reporting timing information.
+func (c Context) SetTimingFunc(f func(op string, d time.Duration)) {
+	c.s.mu.Lock()
+	c.s.timing = f
+	c.s.mu.Unlock()
+}
+
+// Report that op took d to the timing function of c, if any.
+func (c Context) reportTiming(op string, d time.Duration) {
+	c.s.mu.RLock()
+	f := c.s.timing
+	c.s.mu.RUnlock()
+
+	if f != nil {
+		f(op, d)
+	}
+}
@@ -0,0 +1,68 @@
+package openkey
+
+import "strconv"
+
+// A tracer creating spans for card operations, see SetTracer(). Implement
+// this interface to bridge to a tracing system such as OpenTelemetry.
+type Tracer interface {
+	// Start a span for the operation name, e.g. "AuthenticateCard".
+	StartSpan(name string) Span
+}
+
+// A span of a card operation created by a Tracer.
+type Span interface {
+	// Attach an attribute to the span. The attributes set are "role"
+	// ("producer", "manager", or "authenticator"), "slot" for operations
+	// given a slot, and "card_id" once the card ID is known.
+	SetAttribute(key, value string)
+
+	// End the span. err is the error the operation failed with or nil if
+	// it succeeded.
+	End(err error)
+}
+
+// Set a tracer to create a span for each card operation. A span is created
+// for each call to ProducerCardCreate(), ProducerCardRecreate(),
+// ManagerOwnCard(), and AuthenticateCard() and their variants, including the
+// retry AuthenticateCard() makes with a password from the password function.
+// Spans are started and ended on the goroutine performing the operation, see
+// SetOperationTimeout(); an abandoned operation ends its span when it finally
+// returns. Pass nil to stop tracing.
+func (c Context) SetTracer(t Tracer) {
+	c.s.mu.Lock()
+	c.s.tracer = t
+	c.s.mu.Unlock()
+}
+
+// A span doing nothing, used if no tracer is set.
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key, value string) {}
+func (nopSpan) End(err error)                  {}
+
+// Names of the roles for the "role" attribute of spans.
+var roleNames = [...]string{
+	CardProducer:      "producer",
+	LockManager:       "manager",
+	CardAuthenticator: "authenticator",
+}
+
+// Start a span for the operation name performed in role. If slot is not -1,
+// it is attached, too. If c has no tracer, a span doing nothing is returned.
+func (c Context) startSpan(name string, role Role, slot int) Span {
+	c.s.mu.RLock()
+	t := c.s.tracer
+	c.s.mu.RUnlock()
+
+	if t == nil {
+		return nopSpan{}
+	}
+
+	span := t.StartSpan(name)
+	span.SetAttribute("role", roleNames[role])
+	if slot != -1 {
+		span.SetAttribute("slot", strconv.Itoa(slot))
+	}
+
+	return span
+}
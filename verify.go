@@ -0,0 +1,59 @@
+package openkey
+
+import "github.com/clausecker/freefare"
+
+// The outcome of verifying a card with VerifyCards().
+type VerifyResult struct {
+	CardID string // the card ID if known, also for revoked cards
+	Err    error  // nil if the card is valid
+}
+
+// Authenticate each of tags like AuthenticateCard() to check that the cards
+// are still valid, e.g. when sweeping returned cards. Unlike AuthenticateAny(),
+// all cards are tried even if some fail. The results are returned in the order
+// of tags. A card passes if its result has no error; otherwise Err is the error
+// from AuthenticateCard(), so failures can be told apart as described there:
+// ErrNotOpenkeyCard for cards without openkey applications, ErrWrongPassword
+// for cards refusing pw, ErrCardRevoked for revoked cards, and errors from the
+// tag for damaged or rekeyed cards. Use ReaderNeedsReset() to find failures of
+// the reader itself. If no authenticator role has been added to c,
+// ErrRoleNotAdded is returned and no card is tried. Each tag must be inactive.
+func (c Context) VerifyCards(tags []freefare.DESFireTag, pw []byte) ([]VerifyResult, error) {
+	_, err := c.basePath(CardAuthenticator)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]VerifyResult, len(tags))
+	for i, tag := range tags {
+		results[i].CardID, results[i].Err = c.AuthenticateCard(tag, pw)
+	}
+
+	return results, nil
+}
+
+// Find card IDs that appear in more than one of results, e.g. as returned by
+// VerifyCards(). As each card produced by the libopenkey has an ID of its
+// own, a duplicate ID points to a cloned card. The duplicates are returned
+// keyed by card ID along with the indices of the results carrying them in
+// ascending order.
+// Results without a card ID are ignored; results for failed cards with a known
+// ID, e.g. revoked cards, are considered. If there are no duplicates, an empty
+// map is returned. Notice that passing the same tag twice yields a duplicate,
+// too.
+func FindDuplicateIDs(results []VerifyResult) map[string][]int {
+	indices := make(map[string][]int)
+	for i, r := range results {
+		if r.CardID != "" {
+			indices[r.CardID] = append(indices[r.CardID], i)
+		}
+	}
+
+	for id, idx := range indices {
+		if len(idx) < 2 {
+			delete(indices, id)
+		}
+	}
+
+	return indices
+}